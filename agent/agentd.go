@@ -1,11 +1,13 @@
 package agent
 
 import (
+	p "github.com/domac/mafio/packet"
 	"github.com/domac/mafio/version"
 	"net"
 	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,9 +24,16 @@ type Agentd struct {
 	waitGroup                 WaitGroupWrapper
 	messageCollectStartedChan chan int
 
-	Inchan   chan []byte //数据输入通道
-	Outchan  chan []byte //数据输出通道
+	Inchan   chan *p.Packet //数据输入通道
+	Outchan  chan *p.Packet //数据输出通道
 	exitChan chan int
+	router   *Router //事件路由
+
+	configSource  ConfigSource //配置源
+	configVersion string       //当前应用的配置版本
+
+	inflight      int32 //过滤、路由、输出正在处理的事件批次数
+	writeFailures int64 //输出发送失败的批次数
 
 	isExit bool //退出标识
 	paused bool //暂停标识
@@ -69,15 +78,30 @@ func New(opts *Options, pluginsConf interface{}) *Agentd {
 		opts.LoadPluginsConf(configs)
 	}
 
+	//命令行覆盖优先于配置文件
+	if err := opts.ApplyConfigOverrides(); err != nil {
+		opts.Logger.Fatalf("apply config overrides failed - %s", err)
+	}
+
 	a := &Agentd{
 		opts:                      opts,
 		exitChan:                  make(chan int),
-		Inchan:                    make(chan []byte, opts.MaxReadChannelSize),
-		Outchan:                   make(chan []byte, opts.MaxWriteChannelSize),
+		Inchan:                    make(chan *p.Packet, opts.MaxReadChannelSize),
+		Outchan:                   make(chan *p.Packet, opts.MaxWriteChannelSize),
 		messageCollectStartedChan: make(chan int),
 		paused: false,
 	}
 	a.opts.Logger.Infof(version.Verbose("mafio"))
+
+	//配置中心: 启动时先同步一次, 保证插件启动时使用最新配置
+	source, err := newConfigSource(opts)
+	if err != nil {
+		opts.Logger.Fatalf("create config source failed - %s", err)
+	}
+	if source != nil {
+		a.configSource = source
+		a.syncConfig(source)
+	}
 	return a
 }
 
@@ -86,6 +110,13 @@ func (self *Agentd) GetOptions() *Options {
 
 }
 
+//当前应用的配置版本
+func (self *Agentd) ConfigVersion() string {
+	self.RLock()
+	defer self.RUnlock()
+	return self.configVersion
+}
+
 // 清空agent的数据
 // 输出通道和输入通道的消息会被立刻清理
 func (self *Agentd) Empty() error {
@@ -100,26 +131,103 @@ func (self *Agentd) Empty() error {
 		}
 	}
 finish:
+	if self.router != nil {
+		for _, queue := range self.router.queues {
+			drainQueue(queue)
+		}
+	}
 	return nil
 }
 
+func drainQueue(queue chan *p.Packet) {
+	for {
+		select {
+		case <-queue:
+		default:
+			return
+		}
+	}
+}
+
 func (self *Agentd) GetExitCh() chan int {
 	return self.exitChan
 }
 
 //后台程序退出
 func (self *Agentd) Exit() {
+	self.Lock()
+	if self.isExit {
+		self.Unlock()
+		return
+	}
+	self.isExit = true
+	self.Unlock()
+
 	self.opts.Logger.Warnf("agentd program is exiting ...")
 	if self.httpListener != nil {
 		self.httpListener.Close()
 	}
+	//只关闭 exitChan, 输入与处理协程都在 exitChan 关闭后结束
+	//Inchan 与 Outchan 不关闭, 避免还在发送的输入插件 panic
 	close(self.exitChan)
-	close(self.Inchan)
-	close(self.Outchan)
-	self.isExit = true
 	self.waitGroup.Wait()
 }
 
+//数据发送完成后退出
+//输入插件的数据已经读完时调用(例如标准输入遇到 EOF)
+//等待已采集的事件全部经过过滤、路由并由输出发送完成, 然后退出进程
+func (self *Agentd) ExitAfterFlush() {
+	self.opts.Logger.Infoln("input finished, wait for outputs to flush")
+	if !self.WaitFlushed() {
+		return
+	}
+	self.opts.Logger.Infoln("flush finish now")
+	self.Exit()
+	os.Exit(0)
+}
+
+//等待已采集的事件全部发送完成, agent 先退出时返回 false
+func (self *Agentd) WaitFlushed() bool {
+	interval := time.Duration(self.opts.SendInterval) * time.Millisecond
+	//连续两次检查都没有待处理的事件, 才认为发送完成
+	for idle := 0; idle < 2; {
+		select {
+		case <-self.exitChan:
+			return false
+		case <-time.After(interval):
+		}
+		if self.flushed() {
+			idle++
+		} else {
+			idle = 0
+		}
+	}
+	return true
+}
+
+//输出发送失败的批次数
+//需要确认事件已经发送的输入(例如批量读取文件)比较前后的值, 有失败时不保存读取位置
+func (self *Agentd) WriteFailures() int64 {
+	return atomic.LoadInt64(&self.writeFailures)
+}
+
+//各通道与输出队列均为空, 且没有正在处理的事件
+func (self *Agentd) flushed() bool {
+	if len(self.Inchan) > 0 || len(self.Outchan) > 0 || atomic.LoadInt32(&self.inflight) > 0 {
+		return false
+	}
+	self.RLock()
+	defer self.RUnlock()
+	if self.router != nil {
+		for _, queue := range self.router.queues {
+			if len(queue) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 //强制退出
 func (self *Agentd) SafeExit() {
 	self.opts.Logger.Warnf("agentd program is safe exiting ...")
@@ -127,8 +235,6 @@ func (self *Agentd) SafeExit() {
 		self.httpListener.Close()
 	}
 	close(self.exitChan)
-	close(self.Inchan)
-	close(self.Outchan)
 	self.isExit = true
 	//让发送操作完成才退出
 	for {
@@ -180,6 +286,16 @@ func (self *Agentd) Main() {
 	// 这样容易导致内存消息堆积,引起无法控制的情况
 	<-self.messageCollectStartedChan
 
+	//配置中心轮询
+	if self.configSource != nil {
+		self.waitGroup.Wrap(func() { ctx.configPoll(self.configSource) })
+	}
+
+	//服务注册
+	if self.opts.EtcdEndpoint != "" {
+		self.waitGroup.Wrap(func() { ctx.register() })
+	}
+
 	//异步filer处理
 	self.waitGroup.Wrap(func() { ctx.messagesFilted() })
 
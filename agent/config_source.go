@@ -0,0 +1,451 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/domac/mafio/discovery"
+	"github.com/domac/mafio/util"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+//*****************************************
+//
+// 配置源 (Config Source)
+//
+// 除了本地配置文件, agent 还可以按 group/id 从配置中心拉取插件配置:
+// 校验通过后通过 reload 应用, 并把应用结果上报给配置中心;
+// 配置中心不可用时, 使用磁盘上缓存的最后一次可用配置
+//
+//*****************************************
+
+//配置文档
+//plugins 中每一项的格式与插件配置文件一致, 必须包含 @pluginName
+type ConfigDocument struct {
+	Version string                   `json:"version"`
+	Plugins []map[string]interface{} `json:"plugins"`
+}
+
+//配置源接口
+type ConfigSource interface {
+	Name() string
+	//拉取当前的配置
+	Fetch() (*ConfigDocument, error)
+	//上报配置应用结果, applyErr 为空表示应用成功
+	Report(version string, result *ConfigApplyResult, applyErr error) error
+}
+
+const (
+	ConfigApplied         = "applied"
+	ConfigRestartRequired = "restart_required"
+	ConfigRejected        = "rejected"
+)
+
+//配置应用结果
+//Reloaded 为已经重新加载配置的插件, RestartRequired 为配置有变化但不支持重新加载、需要重启 agent 的插件
+type ConfigApplyResult struct {
+	Reloaded        []string
+	RestartRequired []string
+}
+
+//配置应用状态
+type ConfigStatus struct {
+	Id              string   `json:"id"`
+	Group           string   `json:"group"`
+	Version         string   `json:"version"`
+	Status          string   `json:"status"` //applied, restart_required, rejected
+	Reloaded        []string `json:"reloaded,omitempty"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	Time            int64    `json:"time"`
+}
+
+func newConfigStatus(opts *Options, version string, result *ConfigApplyResult, applyErr error) *ConfigStatus {
+	status := &ConfigStatus{
+		Id:      opts.AgentId,
+		Group:   opts.AgentGroup,
+		Version: version,
+		Status:  ConfigApplied,
+		Time:    time.Now().Unix(),
+	}
+	if applyErr != nil {
+		status.Status = ConfigRejected
+		status.Error = applyErr.Error()
+		return status
+	}
+	if result != nil {
+		status.Reloaded = result.Reloaded
+		status.RestartRequired = result.RestartRequired
+		if len(result.RestartRequired) > 0 {
+			status.Status = ConfigRestartRequired
+		}
+	}
+	return status
+}
+
+//根据参数创建配置源, 没有配置时返回 nil
+func newConfigSource(opts *Options) (ConfigSource, error) {
+	switch opts.ConfigSource {
+	case "":
+		return nil, nil
+	case "file":
+		return &FileConfigSource{paths: opts.pluginsConfPaths}, nil
+	case "http":
+		if opts.ConfigURL == "" {
+			return nil, errors.New("config source http needs -config-url")
+		}
+		return &HTTPConfigSource{
+			URL:    strings.TrimRight(opts.ConfigURL, "/"),
+			opts:   opts,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "etcd":
+		if opts.EtcdEndpoint == "" {
+			return nil, errors.New("config source etcd needs -etcd-endpoint")
+		}
+		return &EtcdConfigSource{
+			Prefix: opts.ConfigEtcdPrefix,
+			opts:   opts,
+			client: discovery.NewEtcdClient(strings.Split(opts.EtcdEndpoint, ","), 10*time.Second),
+		}, nil
+	}
+	return nil, errors.New("unknown config source: " + opts.ConfigSource)
+}
+
+//本地文件配置源
+//定期重新读取插件配置文件, 文件内容变化后重新应用
+type FileConfigSource struct {
+	paths []string
+}
+
+func (self *FileConfigSource) Name() string {
+	return "file"
+}
+
+func (self *FileConfigSource) Fetch() (*ConfigDocument, error) {
+	doc := &ConfigDocument{}
+	h := md5.New()
+	for _, p := range self.paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(b)
+		content := make(map[string]interface{})
+		if err = json.Unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+		doc.Plugins = append(doc.Plugins, content)
+	}
+	doc.Version = fmt.Sprintf("%x", h.Sum(nil))
+	return doc, nil
+}
+
+func (self *FileConfigSource) Report(version string, result *ConfigApplyResult, applyErr error) error {
+	return nil
+}
+
+//http 配置源
+//拉取: GET <url>/<group>/<id>
+//上报: POST <url>/<group>/<id>/status
+type HTTPConfigSource struct {
+	URL    string
+	opts   *Options
+	client *http.Client
+}
+
+func (self *HTTPConfigSource) Name() string {
+	return "http"
+}
+
+func (self *HTTPConfigSource) agentURL() string {
+	return self.URL + "/" + self.opts.AgentGroup + "/" + self.opts.AgentId
+}
+
+func (self *HTTPConfigSource) Fetch() (*ConfigDocument, error) {
+	resp, err := self.client.Get(self.agentURL())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch config from %s: %s", self.agentURL(), resp.Status)
+	}
+	doc := &ConfigDocument{}
+	if err = json.Unmarshal(b, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (self *HTTPConfigSource) Report(version string, result *ConfigApplyResult, applyErr error) error {
+	b, err := json.Marshal(newConfigStatus(self.opts, version, result, applyErr))
+	if err != nil {
+		return err
+	}
+	resp, err := self.client.Post(self.agentURL()+"/status", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("report config status: %s", resp.Status)
+	}
+	return nil
+}
+
+//etcd 配置源
+//拉取: <prefix>/<group>/<id>, 不存在时使用组配置 <prefix>/<group>
+//上报: <prefix>-status/<group>/<id>
+type EtcdConfigSource struct {
+	Prefix string
+	opts   *Options
+	client *discovery.EtcdClient
+}
+
+func (self *EtcdConfigSource) Name() string {
+	return "etcd"
+}
+
+func (self *EtcdConfigSource) Fetch() (*ConfigDocument, error) {
+	keys := []string{
+		path.Join(self.Prefix, self.opts.AgentGroup, self.opts.AgentId),
+		path.Join(self.Prefix, self.opts.AgentGroup),
+	}
+	for _, key := range keys {
+		kv, err := self.client.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if kv == nil {
+			continue
+		}
+		doc := &ConfigDocument{}
+		if err = json.Unmarshal(kv.Value, doc); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("no config found at %s", keys[0])
+}
+
+func (self *EtcdConfigSource) Report(version string, result *ConfigApplyResult, applyErr error) error {
+	b, err := json.Marshal(newConfigStatus(self.opts, version, result, applyErr))
+	if err != nil {
+		return err
+	}
+	key := path.Join(self.Prefix+"-status", self.opts.AgentGroup, self.opts.AgentId)
+	return self.client.Put(key, string(b), 0)
+}
+
+//校验配置文档, 返回按插件名称组织的配置
+func validateConfigDocument(doc *ConfigDocument) (map[string]map[string]interface{}, error) {
+	if doc.Version == "" {
+		return nil, errors.New("config without version")
+	}
+	configs := make(map[string]map[string]interface{})
+	for i, conf := range doc.Plugins {
+		name, ok := conf["@pluginName"].(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("plugins[%d] didn't include @pluginName", i)
+		}
+		kinds, registered := declaredConfigKinds(name)
+		if !registered {
+			return nil, fmt.Errorf("plugins[%d]: unknown plugin %s", i, name)
+		}
+		for key, kind := range kinds {
+			v, exist := conf[key]
+			if !exist || v == nil {
+				continue
+			}
+			if !configKindMatch(reflect.ValueOf(v).Kind(), kind) {
+				return nil, fmt.Errorf("%s.%s: want %s, got %T", name, key, kind, v)
+			}
+		}
+		configs[name] = conf
+	}
+	return configs, nil
+}
+
+//json 中的数字统一为 float64
+func configKindMatch(got, want reflect.Kind) bool {
+	switch want {
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return got == reflect.Float64
+	}
+	return got == want
+}
+
+//读取磁盘上缓存的配置
+func loadConfigCache(cachePath string) (*ConfigDocument, error) {
+	b, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	doc := &ConfigDocument{}
+	if err = json.Unmarshal(b, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+//缓存配置到磁盘, 先写临时文件再改名, 避免写入一半的缓存
+func saveConfigCache(cachePath string, doc *ConfigDocument) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(cachePath, b, 0600)
+}
+
+//从配置源同步配置
+//拉取失败且尚未应用过任何配置时, 使用缓存的配置
+func (self *Agentd) syncConfig(source ConfigSource) {
+	opts := self.opts
+	fromCache := false
+
+	doc, err := source.Fetch()
+	if err != nil {
+		opts.Logger.Warnf("[CONFIG]fetch config from %s failed - %s", source.Name(), err)
+		if self.configVersion != "" || opts.ConfigCachePath == "" {
+			return
+		}
+		if doc, err = loadConfigCache(opts.ConfigCachePath); err != nil {
+			opts.Logger.Warnf("[CONFIG]load config cache %s failed - %s", opts.ConfigCachePath, err)
+			return
+		}
+		opts.Logger.Warnf("[CONFIG]use cached config version %s", doc.Version)
+		fromCache = true
+	}
+
+	if doc.Version == self.configVersion {
+		return
+	}
+
+	result, err := self.applyConfig(doc)
+	if err != nil {
+		opts.Logger.Errorf("[CONFIG]reject config version %s - %s", doc.Version, err)
+	} else {
+		from := source.Name()
+		if fromCache {
+			from = "cache " + opts.ConfigCachePath
+		}
+		opts.Logger.Infof("[CONFIG]applied config version %s from %s", doc.Version, from)
+		if len(result.Reloaded) > 0 {
+			opts.Logger.Infof("[CONFIG]plugins reloaded: %s", strings.Join(result.Reloaded, ", "))
+		}
+		if len(result.RestartRequired) > 0 {
+			opts.Logger.Warnf("[CONFIG]plugins can't reload, restart the agent to apply their config: %s", strings.Join(result.RestartRequired, ", "))
+		}
+		if !fromCache && opts.ConfigCachePath != "" {
+			if cacheErr := saveConfigCache(opts.ConfigCachePath, doc); cacheErr != nil {
+				opts.Logger.Warnf("[CONFIG]save config cache failed - %s", cacheErr)
+			}
+		}
+	}
+
+	if reportErr := source.Report(doc.Version, result, err); reportErr != nil {
+		opts.Logger.Warnf("[CONFIG]report config version %s failed - %s", doc.Version, reportErr)
+	}
+}
+
+//应用配置文档
+//配置文件 < 配置中心 < 命令行覆盖, 应用后通知配置有变化的插件重新加载
+func (self *Agentd) applyConfig(doc *ConfigDocument) (*ConfigApplyResult, error) {
+	opts := self.opts
+	remote, err := validateConfigDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := copyPluginsConfigs(opts.filePluginConfigs)
+	for name, conf := range copyPluginsConfigs(remote) {
+		configs[name] = conf
+	}
+	if err = opts.applyConfigOverrides(configs); err != nil {
+		return nil, err
+	}
+
+	old := opts.PluginConfigsSnapshot()
+	opts.setPluginsConfigs(configs)
+	self.Lock()
+	self.configVersion = doc.Version
+	self.Unlock()
+
+	return self.refleshPlugins(old, configs), nil
+}
+
+//通知配置有变化的插件重新加载配置
+//不支持重新加载的插件只记录在 RestartRequired 中
+func (self *Agentd) refleshPlugins(old, configs map[string]map[string]interface{}) *ConfigApplyResult {
+	result := &ConfigApplyResult{}
+	self.RLock()
+	router := self.router
+	self.RUnlock()
+
+	//输出器还没有初始化时, 插件启动时会直接读取最新配置
+	if router == nil {
+		return result
+	}
+	changed := func(name string) bool {
+		return !reflect.DeepEqual(old[name], configs[name])
+	}
+	if input, ok := InputServiceMap[self.opts.Input]; ok && changed(self.opts.Input) {
+		if supportsReload(input) {
+			input.Reflesh()
+			result.Reloaded = append(result.Reloaded, self.opts.Input)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, self.opts.Input)
+		}
+	}
+	outputNames := make([]string, 0, len(router.queues))
+	for outputName := range router.queues {
+		outputNames = append(outputNames, outputName)
+	}
+	sort.Strings(outputNames)
+	for _, outputName := range outputNames {
+		if !changed(outputName) {
+			continue
+		}
+		output := OutputServiceMap[outputName]
+		if supportsReload(output) {
+			output.Reflesh()
+			result.Reloaded = append(result.Reloaded, outputName)
+		} else {
+			result.RestartRequired = append(result.RestartRequired, outputName)
+		}
+	}
+	return result
+}
+
+//定期从配置源同步配置
+func (self *Context) configPoll(source ConfigSource) {
+	interval := time.Duration(self.Agentd.opts.ConfigPollInterval) * time.Second
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	self.Logger().Infof("[CONFIG]poll config from %s every %s", source.Name(), interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.Agentd.syncConfig(source)
+		case <-self.Agentd.exitChan:
+			return
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package agent
 
 import (
+	"errors"
 	pk "github.com/domac/mafio/packet"
 	"math"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,26 +30,33 @@ func (self *Context) messagePull() {
 
 //消息过滤(filter)
 //从iput读入数据,并处理,最后把过滤后的数据丢到输出通道
+//多个过滤器用逗号分隔, 按顺序组成过滤链
 func (self *Context) messagesFilted() {
 
 	filterName := self.Agentd.opts.Filter
 
 	self.Logger().Infof("[FILTER]current filter: <%s>", filterName)
 
-	filterInstance, ok := FilterServiceMap[filterName]
-	if !ok {
-		self.Logger().Errorln("no filter found")
+	filters, err := self.loadFilters(splitNames(filterName))
+	if err != nil {
+		self.Logger().Errorln(err)
 		os.Exit(1)
 	}
-	filterInstance.SetContext(self)
 	for {
 		select {
-		case data, ok := <-self.Agentd.Inchan:
-			if ok {
-				d, err := filterInstance.DoFilter(data)
-				if err == nil {
-					self.Agentd.Outchan <- d
+		case pkt, ok := <-self.Agentd.Inchan:
+			if ok && pkt != nil {
+				atomic.AddInt32(&self.Agentd.inflight, 1)
+				if doFilters(filters, pkt) {
+					//输出阻塞时 agent 退出, 不再等待发送
+					select {
+					case self.Agentd.Outchan <- pkt:
+					case <-self.Agentd.exitChan:
+						atomic.AddInt32(&self.Agentd.inflight, -1)
+						goto exit
+					}
 				}
+				atomic.AddInt32(&self.Agentd.inflight, -1)
 			}
 		case <-self.Agentd.exitChan:
 			goto exit
@@ -58,62 +67,117 @@ exit:
 
 }
 
+//获取过滤器实例
+func (self *Context) loadFilters(names []string) ([]FilterService, error) {
+	filters := []FilterService{}
+	for _, name := range names {
+		filterInstance, ok := FilterServiceMap[name]
+		if !ok {
+			return nil, errors.New("no filter found: " + name)
+		}
+		filterInstance.SetContext(self)
+		filters = append(filters, filterInstance)
+	}
+	return filters, nil
+}
+
+//依次经过过滤链, 返回 false 表示事件被丢弃
+func doFilters(filters []FilterService, pkt *pk.Packet) bool {
+	for _, filterInstance := range filters {
+		d, err := filterInstance.DoFilter(pkt.Data)
+		if err != nil {
+			return false
+		}
+		pkt.Data = d
+	}
+	return true
+}
+
 //消息发送(output)
 //消息输出的基础设施环境初始化优先
 //这样可以最大限度降低消息积压
 //因为如果负责消费输出的环境没初始化好,那些生产者输入器就会
 //短时间制造很多数据,容易积压
+//
+//过滤后的事件经过路由器分发到各个输出的发送队列, 每个输出独立批量发送
 func (self *Context) messagesPush() {
 
-	maxWirteBulkSize := self.Agentd.opts.MaxWriteBulkSize
-	//批量bulk
-	packets := make([]*pk.Packet, 0, maxWirteBulkSize)
-
-	outputName := self.Agentd.opts.Output
-
-	self.Logger().Infof("[OUTPUT]current output: <%s>", outputName)
-
-	outputInstance, ok := OutputServiceMap[outputName]
-	if !ok {
-		self.Logger().Errorln("no output found")
+	router, err := newRouter(self)
+	if err != nil {
+		self.Logger().Errorln(err)
 		os.Exit(1)
 	}
-	outputInstance.SetContext(self)
+	self.Agentd.Lock()
+	self.Agentd.router = router
+	self.Agentd.Unlock()
+
+	for outputName, queue := range router.queues {
+		self.Logger().Infof("[OUTPUT]current output: <%s>", outputName)
+		outputInstance := OutputServiceMap[outputName]
+		outputInstance.SetContext(self)
+		name, q := outputName, queue
+		self.Agentd.waitGroup.Wrap(func() { self.outputLoop(name, outputInstance, q) })
+	}
 	//关闭messageCollectStartedChan, 宣告输出器的初始化工作已经完成
 	//其它工作组件可以往下走
 	close(self.Agentd.messageCollectStartedChan)
 
+	for {
+		select {
+		case pkt, ok := <-self.Agentd.Outchan:
+			if ok && pkt != nil {
+				atomic.AddInt32(&self.Agentd.inflight, 1)
+				router.dispatch(pkt)
+				atomic.AddInt32(&self.Agentd.inflight, -1)
+			}
+		case <-self.Agentd.exitChan:
+			goto exit
+		}
+	}
+exit:
+	self.Logger().Warnln("router is closing now")
+}
+
+//单个输出的批量发送
+func (self *Context) outputLoop(outputName string, outputInstance OutputService, queue chan *pk.Packet) {
+
+	maxWirteBulkSize := self.Agentd.opts.MaxWriteBulkSize
+	//批量bulk
+	packets := make([]*pk.Packet, 0, maxWirteBulkSize)
+
 	interval := time.Duration(self.Agentd.opts.SendInterval)
-	self.Logger().Infof("send interval : %d ms", interval)
+	self.Logger().Infof("[OUTPUT]<%s> send interval : %d ms", outputName, interval)
 
 	for {
 		select {
-		case data, ok := <-self.Agentd.Outchan:
+		case pkg, ok := <-queue:
 			if ok {
-				pkg := pk.NewPacket(data)
-				//output.DoWrite(pkg)
+				atomic.AddInt32(&self.Agentd.inflight, 1)
 				packets = append(packets, pkg)
 
 				//计算当前输出通道的实际需求大小
-				chanlen := int(math.Min(float64(len(self.Agentd.Outchan)), float64(maxWirteBulkSize)))
+				chanlen := int(math.Min(float64(len(queue)), float64(maxWirteBulkSize)))
 
 				//如果channel的长度还有数据, 批量最多读取maxWirteBulkSize条数据,再合并写出
 				//减少系统调用
 				//减少网络传输, 提高资源利用率
 				for i := 0; i < chanlen; i++ {
-					p := <-self.Agentd.Outchan
-					if nil != p {
-						rpkg := pk.NewPacket(p)
+					rpkg := <-queue
+					if nil != rpkg {
 						packets = append(packets, rpkg)
 					}
 				}
 
 				//输出数据存在的情况下
 				if len(packets) > 0 {
-					outputInstance.DoWrite(packets)
+					if err := outputInstance.DoWrite(packets); err != nil {
+						atomic.AddInt64(&self.Agentd.writeFailures, 1)
+						self.Logger().Errorf("[OUTPUT]<%s> write %d events failed - %s", outputName, len(packets), err)
+					}
 					//回收包裹空间, 清理内存
 					packets = packets[:0]
 				}
+				atomic.AddInt32(&self.Agentd.inflight, -1)
 			}
 		case <-self.Agentd.exitChan:
 			goto exit
@@ -123,7 +187,7 @@ func (self *Context) messagesPush() {
 		}
 	}
 exit:
-	self.Logger().Warnln("output is closing now")
+	self.Logger().Warnf("output <%s> is closing now", outputName)
 }
 
 //性能监控
@@ -43,7 +43,8 @@ var defaultLogger *logrus.Logger
 
 func init() {
 	defaultLogger = logrus.New()
-	SetLogOut(defaultLogger, "stdout")
+	//日志输出到标准错误, 标准输出留给 stdout 输出插件
+	SetLogOut(defaultLogger, "stderr")
 	SetLogLevel(defaultLogger, "debug")
 	defaultLogger.Formatter = &logrus.TextFormatter{
 		TimestampFormat: "2006-01-02 15:04:05",
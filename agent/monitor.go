@@ -8,7 +8,8 @@ import (
 
 func DoMetrics(influxdb_addr, influxdb_db, user, password string, interval time.Duration) {
 	//debug输出信息(输出测试)
-	r := m.NewRegistry()
+	//使用全局的 registry, 插件注册的指标(例如输出压缩比)一起上报
+	r := m.DefaultRegistry
 	m.RegisterDebugGCStats(r)
 	m.RegisterRuntimeMemStats(r)
 	go m.CaptureDebugGCStats(r, interval)
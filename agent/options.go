@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 //配置选项
@@ -22,17 +23,34 @@ type Options struct {
 	AgentGroup          string `flag:"m-group"`
 	Logger              Logger
 
-	Input  string `flag:"input"`
-	Output string `flag:"output"`
-	Filter string `flag:"filter"`
+	Input       string `flag:"input"`
+	Output      string `flag:"output"`
+	Filter      string `flag:"filter"`
+	RouteConfig string `flag:"route-config"`
 
 	//插件参数
 	InfluxdbAddr string `flag:"influxdb-addr"`
-	FormatStr    string `flag:"f"`
+
+	//服务发现
+	EtcdEndpoint string `flag:"etcd-endpoint"`
+	EtcdPrefix   string `flag:"etcd-prefix"`
+	EtcdTTL      int    `flag:"etcd-ttl"`
+
+	//配置中心
+	ConfigSource       string `flag:"config-source"`
+	ConfigURL          string `flag:"config-url"`
+	ConfigEtcdPrefix   string `flag:"config-etcd-prefix"`
+	ConfigPollInterval int    `flag:"config-poll-interval"`
+	ConfigCachePath    string `flag:"config-cache-path"`
 
 	//插件配置数据
-	PluginsConfigs map[string]map[string]interface{}
-	ConfigFilePath string
+	PluginsConfigs  map[string]map[string]interface{}
+	ConfigFilePath  string
+	ConfigOverrides []string //命令行 -set 覆盖项
+
+	configLock        sync.RWMutex
+	pluginsConfPaths  []string                          //插件配置文件路径
+	filePluginConfigs map[string]map[string]interface{} //配置文件中的插件配置
 }
 
 func NewOptions(configFilePath string) *Options {
@@ -63,19 +81,13 @@ func (self *Options) LoadPluginsConf(pluginsConf []string) error {
 	}
 
 	for _, confPath := range pluginsConf {
-		//获取相对路径信息
-		confPath = strings.TrimSpace(confPath)
-		realPath := ""
-		if strings.HasPrefix(confPath, "/") {
-			realPath, _ = filepath.Abs(confPath)
-		} else {
-			realPath = filepath.Join(dir, confPath)
-		}
+		realPath := self.resolveConfPath(confPath)
 
 		if !util.IsExist(realPath) {
 			self.Logger.Warnf("plugin config file didn't exist : %s", realPath)
 			continue
 		}
+		self.pluginsConfPaths = append(self.pluginsConfPaths, realPath)
 		//刷新配置
 		err := self.flushConfig(realPath)
 		if err != nil {
@@ -86,25 +98,84 @@ func (self *Options) LoadPluginsConf(pluginsConf []string) error {
 	return nil
 }
 
+//获取插件配置
+func (self *Options) PluginConfig(name string) (map[string]interface{}, bool) {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	conf, ok := self.PluginsConfigs[name]
+	return conf, ok
+}
+
+//获取全部插件配置的快照
+func (self *Options) PluginConfigsSnapshot() map[string]map[string]interface{} {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return copyPluginsConfigs(self.PluginsConfigs)
+}
+
+//替换全部插件配置
+func (self *Options) setPluginsConfigs(configs map[string]map[string]interface{}) {
+	self.configLock.Lock()
+	self.PluginsConfigs = configs
+	self.configLock.Unlock()
+}
+
+//复制插件配置(每个插件的配置映射浅复制)
+func copyPluginsConfigs(configs map[string]map[string]interface{}) map[string]map[string]interface{} {
+	out := make(map[string]map[string]interface{}, len(configs))
+	for name, conf := range configs {
+		c := make(map[string]interface{}, len(conf))
+		for k, v := range conf {
+			c[k] = v
+		}
+		out[name] = c
+	}
+	return out
+}
+
+//获取配置文件的真实路径
+//相对路径以主配置文件所在目录为基准
+func (self *Options) resolveConfPath(confPath string) string {
+	confPath = strings.TrimSpace(confPath)
+	if strings.HasPrefix(confPath, "/") || self.ConfigFilePath == "" {
+		realPath, _ := filepath.Abs(confPath)
+		return realPath
+	}
+	cfp, _ := filepath.Abs(self.ConfigFilePath)
+	return filepath.Join(filepath.Dir(cfp), confPath)
+}
+
 //读取指定了路径的文件,把内容刷新到全局配置映射中
 func (self *Options) flushConfig(realPath string) error {
 	b, err := ioutil.ReadFile(realPath)
 	if err != nil {
 		return err
 	}
+	key, content, err := parsePluginConfig(b)
+	if err != nil {
+		return errors.New(err.Error() + ": " + realPath)
+	}
+	self.PluginsConfigs[key] = content
+	if self.filePluginConfigs == nil {
+		self.filePluginConfigs = make(map[string]map[string]interface{})
+	}
+	self.filePluginConfigs[key] = content
+	return nil
+}
+
+//解析插件配置, 返回插件名称与配置内容
+func parsePluginConfig(b []byte) (string, map[string]interface{}, error) {
 	content := make(map[string]interface{})
-	err = json.Unmarshal(b, &content)
+	err := json.Unmarshal(b, &content)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 	//获取匹配的插件名称
-	pluginName, ok := content["@pluginName"]
-	if !ok {
+	pluginName, ok := content["@pluginName"].(string)
+	if !ok || pluginName == "" {
 		//如果没有配置插件名称, 则任务配置不合法
-		return errors.New("config file didn't include @pluginName: " + realPath)
+		return "", nil, errors.New("config didn't include @pluginName")
 	}
-	key := pluginName.(string)
 	//delete(content, "@pluginName")
-	self.PluginsConfigs[key] = content
-	return nil
+	return pluginName, content, nil
 }
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//命令行配置覆盖
+//
+//格式: -set <plugin>.<key>=<value>
+//插件配置按 @pluginName 保存, 每个插件只有一份配置, 覆盖项也只能按插件名称指定
+//覆盖的值会按插件配置项的类型进行校验与转换, 然后写入 PluginsConfigs
+//每次加载配置都在副本上应用覆盖, 配置文件中的内容保持不变
+//类型优先取配置文件中已有的值, 其次取插件通过 ConfigDeclarer 声明的类型
+
+//解析单条覆盖表达式
+func parseOverride(expr string) (plugin, key, value string, err error) {
+	kv := strings.SplitN(expr, "=", 2)
+	if len(kv) != 2 {
+		err = fmt.Errorf("invalid override %q, want <plugin>.<key>=<value>", expr)
+		return
+	}
+	target := strings.TrimSpace(kv[0])
+	value = strings.TrimSpace(kv[1])
+
+	idx := strings.Index(target, ".")
+	if idx <= 0 || idx == len(target)-1 {
+		err = fmt.Errorf("invalid override %q, want <plugin>.<key>=<value>", expr)
+		return
+	}
+	plugin = target[:idx]
+	key = target[idx+1:]
+	return
+}
+
+//查找已注册插件声明的配置类型
+func declaredConfigKinds(name string) (kinds map[string]reflect.Kind, registered bool) {
+	var plugin interface{}
+	if i, ok := InputServiceMap[name]; ok {
+		plugin = i
+	} else if o, ok := OutputServiceMap[name]; ok {
+		plugin = o
+	} else if f, ok := FilterServiceMap[name]; ok {
+		plugin = f
+	} else {
+		return nil, false
+	}
+	if d, ok := plugin.(ConfigDeclarer); ok {
+		kinds = d.ConfigKinds()
+	}
+	return kinds, true
+}
+
+//把字符串值转换成与json配置一致的类型
+func coerceConfigValue(value string, kind reflect.Kind) (interface{}, error) {
+	switch kind {
+	case reflect.String:
+		return value, nil
+	case reflect.Float64, reflect.Int, reflect.Int64:
+		return strconv.ParseFloat(value, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Slice:
+		out := []interface{}{}
+		if strings.HasPrefix(value, "[") {
+			err := json.Unmarshal([]byte(value), &out)
+			return out, err
+		}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+		return out, nil
+	case reflect.Map:
+		out := map[string]interface{}{}
+		err := json.Unmarshal([]byte(value), &out)
+		return out, err
+	}
+	return nil, fmt.Errorf("unsupported config type %s", kind)
+}
+
+//应用命令行配置覆盖
+//需要在插件注册与插件配置文件加载之后调用
+func (self *Options) ApplyConfigOverrides() error {
+	self.configLock.Lock()
+	defer self.configLock.Unlock()
+	configs := copyPluginsConfigs(self.PluginsConfigs)
+	if err := self.applyConfigOverrides(configs); err != nil {
+		return err
+	}
+	self.PluginsConfigs = configs
+	return nil
+}
+
+//把命令行覆盖写入指定的插件配置
+//会修改 configs 中的插件配置映射, 调用方需要传入副本
+func (self *Options) applyConfigOverrides(configs map[string]map[string]interface{}) error {
+	for _, expr := range self.ConfigOverrides {
+		plugin, key, value, err := parseOverride(expr)
+		if err != nil {
+			return err
+		}
+
+		kinds, registered := declaredConfigKinds(plugin)
+		conf, hasConf := configs[plugin]
+		if !hasConf && !registered {
+			return errors.New("override target not found: " + plugin)
+		}
+
+		//确定配置项类型
+		kind := reflect.Invalid
+		if old, ok := conf[key]; ok && old != nil {
+			kind = reflect.ValueOf(old).Kind()
+		} else if k, ok := kinds[key]; ok {
+			kind = k
+		}
+		if kind == reflect.Invalid {
+			return fmt.Errorf("unknown config key %q for plugin %s", key, plugin)
+		}
+
+		v, err := coerceConfigValue(value, kind)
+		if err != nil {
+			return fmt.Errorf("override %s.%s: value %q is not a valid %s - %s", plugin, key, value, kind, err)
+		}
+
+		if !hasConf {
+			conf = map[string]interface{}{"@pluginName": plugin}
+			configs[plugin] = conf
+		}
+		conf[key] = v
+		self.Logger.Infof("config override %s.%s = %v", plugin, key, v)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package agent
 
 import (
 	p "github.com/domac/mafio/packet"
+	"reflect"
 )
 
 var (
@@ -30,9 +31,10 @@ type InputService interface {
 }
 
 //输出服务接口
+//DoWrite 返回错误表示这批事件没有发送成功
 type OutputService interface {
 	SetContext(*Context)
-	DoWrite([]*p.Packet)
+	DoWrite([]*p.Packet) error
 	Reflesh()
 }
 
@@ -41,3 +43,21 @@ type FilterService interface {
 	SetContext(*Context)
 	DoFilter([]byte) ([]byte, error)
 }
+
+//插件配置声明接口(可选实现)
+//返回插件支持的配置项及其类型, 用于 -set 命令行覆盖时的类型校验
+type ConfigDeclarer interface {
+	ConfigKinds() map[string]reflect.Kind
+}
+
+//支持运行时重新加载配置的插件(可选实现)
+//没有实现的插件 Reflesh 不会应用新的配置, 配置变化后需要重启 agent 才能生效
+type ConfigReloader interface {
+	SupportsReload() bool
+}
+
+//插件是否可以通过 Reflesh 应用新的配置
+func supportsReload(plugin interface{}) bool {
+	reloader, ok := plugin.(ConfigReloader)
+	return ok && reloader.SupportsReload()
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"github.com/domac/mafio/discovery"
+	"github.com/domac/mafio/util"
+	"github.com/domac/mafio/version"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+//服务注册(etcd)
+//注册信息包括 agent 的 http 地址以及当前启用的插件
+func (self *Context) register() {
+	opts := self.Agentd.opts
+
+	hostname, _ := os.Hostname()
+	info := &discovery.AgentInfo{
+		Id:          opts.AgentId,
+		Group:       opts.AgentGroup,
+		HTTPAddress: advertiseAddress(opts.HTTPAddress),
+		Hostname:    hostname,
+		Version:     version.Binary,
+		Input:       opts.Input,
+		Filter:      opts.Filter,
+		Outputs:     self.Agentd.activeOutputs(),
+		StartTime:   time.Now().Unix(),
+	}
+
+	client := discovery.NewEtcdClient(strings.Split(opts.EtcdEndpoint, ","), 5*time.Second)
+	registrar := discovery.NewRegistrar(client, opts.EtcdPrefix, int64(opts.EtcdTTL), info, self.Logger())
+	self.Logger().Infof("[DISCOVERY]register to etcd <%s> with key: %s", opts.EtcdEndpoint, registrar.Key())
+	registrar.Run(self.Agentd.exitChan)
+}
+
+//当前启用的输出插件
+func (self *Agentd) activeOutputs() []string {
+	self.RLock()
+	defer self.RUnlock()
+	outputs := []string{}
+	if self.router != nil {
+		for name := range self.router.queues {
+			outputs = append(outputs, name)
+		}
+	}
+	return outputs
+}
+
+//对外公布的http地址
+//监听地址为空或者为 0.0.0.0 时, 使用内网ip替换
+func advertiseAddress(listenAddr string) string {
+	if listenAddr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if ips, err := util.IntranetIP(); err == nil && len(ips) > 0 {
+			host = ips[0]
+		} else if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,330 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	p "github.com/domac/mafio/packet"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+//*****************************************
+//
+// 事件路由 (Router)
+//
+// 根据事件的字段或标签, 决定事件交给哪些输出
+// 以及在输出前经过哪些过滤分支
+//
+//*****************************************
+
+//路由配置文件格式:
+//
+//	{
+//	  "routes": [
+//	    {
+//	      "name": "http",
+//	      "when": {"field": "PkgType", "eq": "http"},
+//	      "filters": ["valid"],
+//	      "outputs": ["rabbitmq"]
+//	    },
+//	    {
+//	      "name": "tcp",
+//	      "when": {"or": [{"field": "PkgType", "in": ["tcp", "kafka"]}, {"tag": "slow"}]},
+//	      "outputs": ["logr"],
+//	      "final": true
+//	    }
+//	  ],
+//	  "default": {"outputs": ["stdout"]}
+//	}
+//
+//事件会交给所有命中的路由, 路由设置 final 后不再匹配其后的路由
+//没有命中任何路由的事件交给 default, 没有 default 则丢弃
+type RouteConfig struct {
+	Routes  []*Route `json:"routes"`
+	Default *Route   `json:"default,omitempty"`
+}
+
+//路由
+type Route struct {
+	Name    string     `json:"name"`
+	When    *Condition `json:"when,omitempty"`
+	Filters []string   `json:"filters,omitempty"`
+	Outputs []string   `json:"outputs"`
+	Final   bool       `json:"final,omitempty"`
+
+	filters []FilterService
+}
+
+//路由条件
+//叶子条件: field 配合 eq/ne/regex/in 使用, 只有 field 表示字段存在; tag 表示事件带有该标签
+//组合条件: and/or/not
+type Condition struct {
+	Field string        `json:"field,omitempty"`
+	Eq    interface{}   `json:"eq,omitempty"`
+	Ne    interface{}   `json:"ne,omitempty"`
+	Regex string        `json:"regex,omitempty"`
+	In    []interface{} `json:"in,omitempty"`
+	Tag   string        `json:"tag,omitempty"`
+
+	And []*Condition `json:"and,omitempty"`
+	Or  []*Condition `json:"or,omitempty"`
+	Not *Condition   `json:"not,omitempty"`
+
+	re *regexp.Regexp
+}
+
+//载入路由配置
+func LoadRouteConfig(path string) (*RouteConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &RouteConfig{}
+	if err = json.Unmarshal(b, conf); err != nil {
+		return nil, err
+	}
+	for i, route := range conf.Routes {
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("route-%d", i)
+		}
+		if err = route.When.compile(); err != nil {
+			return nil, fmt.Errorf("route %s: %s", route.Name, err)
+		}
+	}
+	if conf.Default != nil {
+		conf.Default.Name = "default"
+		conf.Default.When = nil
+	}
+	return conf, nil
+}
+
+//编译并校验条件
+func (c *Condition) compile() (err error) {
+	if c == nil {
+		return nil
+	}
+
+	combinators := 0
+	for _, sub := range append(append([]*Condition{}, c.And...), c.Or...) {
+		if err = sub.compile(); err != nil {
+			return
+		}
+	}
+	if len(c.And) > 0 {
+		combinators++
+	}
+	if len(c.Or) > 0 {
+		combinators++
+	}
+	if c.Not != nil {
+		combinators++
+		if err = c.Not.compile(); err != nil {
+			return
+		}
+	}
+
+	operators := 0
+	for _, set := range []bool{c.Eq != nil, c.Ne != nil, c.Regex != "", c.In != nil} {
+		if set {
+			operators++
+		}
+	}
+
+	switch {
+	case combinators > 1:
+		return errors.New("condition can only use one of and/or/not")
+	case combinators == 1 && (c.Field != "" || c.Tag != "" || operators > 0):
+		return errors.New("and/or/not can't be mixed with field or tag")
+	case combinators == 1:
+		return nil
+	case c.Tag != "" && (c.Field != "" || operators > 0):
+		return errors.New("tag can't be mixed with field operators")
+	case c.Tag != "":
+		return nil
+	case c.Field == "":
+		return errors.New("condition without field")
+	case operators > 1:
+		return errors.New("field condition can only use one of eq/ne/regex/in")
+	}
+
+	if c.Regex != "" {
+		if c.re, err = regexp.Compile(c.Regex); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+//条件匹配, 空条件总是匹配
+func (c *Condition) Match(pkt *p.Packet) bool {
+	if c == nil {
+		return true
+	}
+
+	switch {
+	case len(c.And) > 0:
+		for _, sub := range c.And {
+			if !sub.Match(pkt) {
+				return false
+			}
+		}
+		return true
+	case len(c.Or) > 0:
+		for _, sub := range c.Or {
+			if sub.Match(pkt) {
+				return true
+			}
+		}
+		return false
+	case c.Not != nil:
+		return !c.Not.Match(pkt)
+	case c.Tag != "":
+		return pkt.HasTag(c.Tag)
+	}
+
+	v, ok := pkt.GetFieldString(c.Field)
+	if !ok {
+		return false
+	}
+
+	switch {
+	case c.Eq != nil:
+		return v == fmt.Sprint(c.Eq)
+	case c.Ne != nil:
+		return v != fmt.Sprint(c.Ne)
+	case c.re != nil:
+		return c.re.MatchString(v)
+	case c.In != nil:
+		for _, in := range c.In {
+			if v == fmt.Sprint(in) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+//事件路由器
+type Router struct {
+	ctx    *Context
+	routes []*Route
+	def    *Route
+	queues map[string]chan *p.Packet //每个输出独立的发送队列
+}
+
+//创建路由器
+//没有配置路由文件时, 所有事件交给 -output 指定的输出(逗号分隔可指定多个)
+func newRouter(ctx *Context) (*Router, error) {
+	opts := ctx.Agentd.opts
+
+	conf := &RouteConfig{}
+	if opts.RouteConfig != "" {
+		routePath := opts.resolveConfPath(opts.RouteConfig)
+		c, err := LoadRouteConfig(routePath)
+		if err != nil {
+			return nil, fmt.Errorf("load route config %s failed - %s", routePath, err)
+		}
+		conf = c
+		ctx.Logger().Infof("[ROUTE]load %d routes from %s", len(conf.Routes), routePath)
+	} else {
+		conf.Default = &Route{Name: "default", Outputs: splitNames(opts.Output)}
+	}
+
+	r := &Router{
+		ctx:    ctx,
+		routes: conf.Routes,
+		def:    conf.Default,
+		queues: make(map[string]chan *p.Packet),
+	}
+
+	routes := r.routes
+	if r.def != nil {
+		routes = append(append([]*Route{}, routes...), r.def)
+	}
+	for _, route := range routes {
+		filters, err := ctx.loadFilters(route.Filters)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %s", route.Name, err)
+		}
+		route.filters = filters
+		if len(route.Outputs) == 0 {
+			return nil, fmt.Errorf("route %s: no output", route.Name)
+		}
+		for _, outputName := range route.Outputs {
+			if _, ok := OutputServiceMap[outputName]; !ok {
+				return nil, fmt.Errorf("route %s: no output found: %s", route.Name, outputName)
+			}
+			if _, ok := r.queues[outputName]; !ok {
+				r.queues[outputName] = make(chan *p.Packet, opts.MaxWriteChannelSize)
+			}
+		}
+	}
+	return r, nil
+}
+
+//拆分逗号分隔的插件名称
+func splitNames(s string) []string {
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//匹配事件命中的路由
+func (self *Router) match(pkt *p.Packet) []*Route {
+	matched := []*Route{}
+	for _, route := range self.routes {
+		if route.When.Match(pkt) {
+			matched = append(matched, route)
+			if route.Final {
+				break
+			}
+		}
+	}
+	if len(matched) == 0 && self.def != nil {
+		matched = append(matched, self.def)
+	}
+	return matched
+}
+
+//路由结果: 经过过滤分支后的事件及其输出
+type routedPacket struct {
+	route *Route
+	pkt   *p.Packet
+}
+
+//计算事件的去向, 被过滤分支丢弃的不在结果中
+func (self *Router) resolve(pkt *p.Packet) []routedPacket {
+	matched := self.match(pkt)
+	result := make([]routedPacket, 0, len(matched))
+	for i, route := range matched {
+		rp := pkt
+		//多个路由命中时, 各自处理副本, 避免过滤分支互相影响
+		if i < len(matched)-1 {
+			rp = pkt.Clone()
+		}
+		if doFilters(route.filters, rp) {
+			result = append(result, routedPacket{route: route, pkt: rp})
+		}
+	}
+	return result
+}
+
+//事件分发, 送入各输出队列
+func (self *Router) dispatch(pkt *p.Packet) {
+	for _, routed := range self.resolve(pkt) {
+		for _, outputName := range routed.route.Outputs {
+			select {
+			case self.queues[outputName] <- routed.pkt:
+			case <-self.ctx.Agentd.exitChan:
+				return
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/domac/mafio/util"
 	"github.com/domac/mafio/version"
 	"github.com/julienschmidt/httprouter"
+	m "github.com/rcrowley/go-metrics"
 	"net/http"
 	"net/http/pprof"
 )
@@ -39,6 +40,8 @@ func newAPIServer(ctx *Context) *ApiServer {
 	router.Handle("GET", "/debug", Decorate(s.pprofHandler, log, PlainText))   //文本形式输出
 	router.Handle("GET", "/ping", Decorate(s.pingHandler, log, PlainText))     //文本形式输出
 	router.Handle("GET", "/empty", Decorate(s.emptyHandler, log, PlainText))   //文本形式输出
+	router.Handle("GET", "/config", Decorate(s.configHandler, log, Default))   //json格式输出
+	router.Handle("GET", "/metrics", Decorate(s.metricsHandler, log, Default)) //json格式输出
 	return s
 }
 
@@ -88,3 +91,18 @@ func (s *ApiServer) emptyHandler(w http.ResponseWriter, req *http.Request, ps ht
 	s.ctx.Agentd.Empty()
 	return "empty is finish", nil
 }
+
+//当前应用的插件配置
+func (s *ApiServer) configHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	opts := s.ctx.Agentd.GetOptions()
+	return map[string]interface{}{
+		"source":  opts.ConfigSource,
+		"version": s.ctx.Agentd.ConfigVersion(),
+		"plugins": opts.PluginConfigsSnapshot(),
+	}, nil
+}
+
+//插件注册的指标, 例如输出压缩的字节数与压缩比
+func (s *ApiServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return m.DefaultRegistry, nil
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//*****************************************
+//
+// 管道测试模式 (dry-run)
+//
+// 从样例文件逐行读入数据, 按输入的编解码转换为事件后经过配置的过滤链与路由,
+// 把每个输出将收到的结果(原始数据、字段与标签)与期望文件比较并打印差异
+// 不会启动真实的输入与输出插件
+//
+//*****************************************
+
+//样例行的最大长度
+const maxSampleLineSize = 1024 * 1024
+
+type PipelineTest struct {
+	SamplePath   string //样例数据文件, 每行一个事件
+	Codec        string //样例的编解码(line、json、json_lines), 为空时使用输入插件配置的 codec
+	ExpectedPath string //期望结果: 只有一个输出时可以是文件, 否则为目录, 每个输出对应 <dir>/<output>.out
+	Update       bool   //用实际结果更新期望文件
+	Out          io.Writer
+}
+
+//执行管道测试, 全部输出与期望一致时返回 true
+func (self *Agentd) RunPipelineTest(t *PipelineTest) (bool, error) {
+	ctx := &Context{self}
+
+	filters, err := ctx.loadFilters(splitNames(self.opts.Filter))
+	if err != nil {
+		return false, err
+	}
+	router, err := newRouter(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	codecName := t.Codec
+	if codecName == "" {
+		codecName = self.inputCodec()
+	}
+	if _, err = codec.DecodeLine(codecName, nil); err != nil {
+		return false, err
+	}
+
+	samples, err := readLines(t.SamplePath)
+	if err != nil {
+		return false, err
+	}
+
+	//各输出实际收到的结果
+	actual := make(map[string][]string)
+	outputs := []string{}
+	for name := range router.queues {
+		actual[name] = []string{}
+		outputs = append(outputs, name)
+	}
+	sort.Strings(outputs)
+
+	dropped := 0
+	for _, line := range samples {
+		pkt, _ := codec.DecodeLine(codecName, []byte(line))
+		if !doFilters(filters, pkt) {
+			dropped++
+			continue
+		}
+		routed := router.resolve(pkt)
+		if len(routed) == 0 {
+			dropped++
+		}
+		for _, r := range routed {
+			for _, outputName := range r.route.Outputs {
+				actual[outputName] = append(actual[outputName], renderTestPacket(r.pkt))
+			}
+		}
+	}
+	fmt.Fprintf(t.Out, "%d samples, %d dropped\n", len(samples), dropped)
+
+	expectedFiles, err := expectedFiles(t, outputs)
+	if err != nil {
+		return false, err
+	}
+
+	passed := true
+	for _, outputName := range outputs {
+		expectedFile := expectedFiles[outputName]
+		if t.Update {
+			if err = writeLines(expectedFile, actual[outputName]); err != nil {
+				return false, err
+			}
+			fmt.Fprintf(t.Out, "output <%s>: %d events, updated %s\n", outputName, len(actual[outputName]), expectedFile)
+			continue
+		}
+
+		expected, err := readLines(expectedFile)
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		if equalLines(expected, actual[outputName]) {
+			fmt.Fprintf(t.Out, "output <%s>: %d events, ok\n", outputName, len(actual[outputName]))
+			continue
+		}
+
+		passed = false
+		fmt.Fprintf(t.Out, "output <%s>: %d events, expected %d, FAIL\n", outputName, len(actual[outputName]), len(expected))
+		fmt.Fprintf(t.Out, "--- %s\n+++ %s (actual)\n", expectedFile, outputName)
+		for _, d := range util.DiffLines(expected, actual[outputName]) {
+			fmt.Fprintln(t.Out, d)
+		}
+	}
+	return passed, nil
+}
+
+//输入插件配置的编解码, 没有配置或者不能按行解码时按行处理
+func (self *Agentd) inputCodec() string {
+	if configMap, ok := self.opts.PluginConfig(self.opts.Input); ok {
+		if name, ok := configMap["codec"].(string); ok && name != "" {
+			if _, err := codec.DecodeLine(name, nil); err == nil {
+				return name
+			}
+		}
+	}
+	return codec.Line
+}
+
+//测试结果中事件的文本形式
+//原始数据之后依次是按字段名排序的字段(fields=<json>)与排序后的标签(tags=a,b), 以 tab 分隔
+func renderTestPacket(pkt *p.Packet) string {
+	parts := []string{string(pkt.Data)}
+	if len(pkt.Fields) > 0 {
+		b, err := json.Marshal(pkt.Fields)
+		if err != nil {
+			b = []byte(fmt.Sprint(pkt.Fields))
+		}
+		parts = append(parts, "fields="+string(b))
+	}
+	if len(pkt.Tags) > 0 {
+		tags := append([]string(nil), pkt.Tags...)
+		sort.Strings(tags)
+		parts = append(parts, "tags="+strings.Join(tags, ","))
+	}
+	return strings.Join(parts, "\t")
+}
+
+//确定每个输出对应的期望文件
+func expectedFiles(t *PipelineTest, outputs []string) (map[string]string, error) {
+	if t.ExpectedPath == "" {
+		return nil, errors.New("no expected path")
+	}
+	files := make(map[string]string)
+
+	fi, err := os.Stat(t.ExpectedPath)
+	isDir := err == nil && fi.IsDir()
+	if os.IsNotExist(err) && t.Update && len(outputs) > 1 {
+		if err = os.MkdirAll(t.ExpectedPath, 0755); err != nil {
+			return nil, err
+		}
+		isDir = true
+	}
+	if !isDir {
+		if len(outputs) > 1 {
+			return nil, fmt.Errorf("expected path %s must be a directory for multiple outputs", t.ExpectedPath)
+		}
+		for _, outputName := range outputs {
+			files[outputName] = t.ExpectedPath
+		}
+		return files, nil
+	}
+
+	for _, outputName := range outputs {
+		files[outputName] = filepath.Join(t.ExpectedPath, outputName+".out")
+	}
+	return files, nil
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxSampleLineSize)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+func writeLines(path string, lines []string) error {
+	content := ""
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	p "github.com/domac/mafio/packet"
+	"io"
+)
+
+//长度前缀编解码
+//每个事件为 4 字节大端序的长度, 后面跟着原始数据
+
+type lengthPrefixedEncoder struct{}
+
+func (lengthPrefixedEncoder) Encode(packets []*p.Packet) ([]byte, error) {
+	size := 0
+	for _, pkt := range packets {
+		size += 4 + len(pkt.Data)
+	}
+	b := make([]byte, 0, size)
+	for _, pkt := range packets {
+		b = appendUint32(b, uint32(len(pkt.Data)))
+		b = append(b, pkt.Data...)
+	}
+	return b, nil
+}
+
+type lengthPrefixedDecoder struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func (self *lengthPrefixedDecoder) Decode() (*p.Packet, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	//长度异常时数据流已经无法继续解析
+	if int64(size) > int64(self.maxSize) {
+		return nil, fmt.Errorf("frame size %d exceeds max size %d", size, self.maxSize)
+	}
+	data, err := readN(self.reader, int(size))
+	if err != nil {
+		return nil, err
+	}
+	return p.NewPacket(data), nil
+}
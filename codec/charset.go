@@ -0,0 +1,205 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+//字符集转换
+//把 GBK、GB18030、Big5、Latin-1、UTF-16 等编码的数据转换为 UTF-8
+//无法解码的字节替换为指定的字符, 默认为 U+FFFD
+
+//字符集
+type Charset struct {
+	name        string
+	encoding    encoding.Encoding
+	replacement rune
+	unitSize    int  //编码单元的字节数, UTF-16 为 2
+	bigEndian   bool //UTF-16 的字节序
+}
+
+//根据名称创建字符集, 名称不区分大小写
+//replacement 为替换无法解码字节的字符, 为空时使用 U+FFFD
+func NewCharset(name, replacement string) (*Charset, error) {
+	c := &Charset{
+		name:        strings.ToLower(name),
+		replacement: utf8.RuneError,
+		unitSize:    1,
+	}
+
+	switch c.name {
+	case "utf-8", "utf8":
+		c.encoding = unicode.UTF8
+	case "gbk", "cp936":
+		c.encoding = simplifiedchinese.GBK
+	case "gb18030":
+		c.encoding = simplifiedchinese.GB18030
+	case "big5":
+		c.encoding = traditionalchinese.Big5
+	case "latin1", "latin-1", "iso-8859-1":
+		c.encoding = charmap.ISO8859_1
+	case "utf-16", "utf-16le":
+		//utf-16 默认小端序, 有 BOM 时按 BOM 确定字节序
+		c.encoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+		c.unitSize = 2
+	case "utf-16be":
+		c.encoding = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+		c.unitSize = 2
+		c.bigEndian = true
+	default:
+		return nil, errors.New("unsupported charset: " + name)
+	}
+
+	if replacement != "" {
+		r, size := utf8.DecodeRuneInString(replacement)
+		if r == utf8.RuneError || size != len(replacement) {
+			return nil, fmt.Errorf("charset replacement must be a single character, got %q", replacement)
+		}
+		c.replacement = r
+	}
+	return c, nil
+}
+
+func (self *Charset) Name() string {
+	return self.name
+}
+
+//是否为 UTF-16 编码, 按行切分时换行符占两个字节
+func (self *Charset) IsUTF16() bool {
+	return self.unitSize == 2
+}
+
+//按数据开头的 BOM 确定 UTF-16 的字节序, 返回新的字符集
+//文件按行切分时, 需要在选择换行符之前确定字节序; 没有 BOM 时使用配置的字节序
+func (self *Charset) WithBOM(head []byte) *Charset {
+	if !self.IsUTF16() || len(head) < 2 {
+		return self
+	}
+	c := *self
+	switch {
+	case head[0] == 0xfe && head[1] == 0xff:
+		c.bigEndian = true
+		c.encoding = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
+	case head[0] == 0xff && head[1] == 0xfe:
+		c.bigEndian = false
+		c.encoding = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	default:
+		return self
+	}
+	return &c
+}
+
+//UTF-16 的换行符
+func (self *Charset) Newline() []byte {
+	if !self.IsUTF16() {
+		return []byte{'\n'}
+	}
+	if self.bigEndian {
+		return []byte{0, '\n'}
+	}
+	return []byte{'\n', 0}
+}
+
+//解码并替换无法解码的字节
+//转换器有内部状态, 每次使用都重新创建
+func (self *Charset) transformer() transform.Transformer {
+	decoder := self.encoding.NewDecoder()
+	if self.replacement == utf8.RuneError {
+		return decoder
+	}
+	return &replaceInvalid{
+		decoder:     decoder,
+		genuine:     self.encodedRuneError(),
+		replacement: string(self.replacement),
+	}
+}
+
+//U+FFFD 在这个字符集中的编码, 无法编码时为空
+//UTF-16 的两种字节序都作为 U+FFFD, 因为数据中的 BOM 可能改变字节序
+func (self *Charset) encodedRuneError() [][]byte {
+	if self.IsUTF16() {
+		return [][]byte{{0xff, 0xfd}, {0xfd, 0xff}}
+	}
+	b, err := self.encoding.NewEncoder().Bytes([]byte(string(utf8.RuneError)))
+	if err != nil || len(b) == 0 {
+		return nil
+	}
+	return [][]byte{b}
+}
+
+//只替换无法解码的字节, 数据中原有的 U+FFFD 保持不变
+//解码器对无效的字节与原有的 U+FFFD 输出相同的字符, 所以每次只解码一个字符, 按对应的原始字节区分
+type replaceInvalid struct {
+	decoder     transform.Transformer
+	genuine     [][]byte
+	replacement string
+}
+
+func (self *replaceInvalid) Reset() {
+	self.decoder.Reset()
+}
+
+func (self *replaceInvalid) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	var buf [utf8.UTFMax]byte
+	for nSrc < len(src) {
+		//保证一个字符或者替换字符一定放得下, 解码器的状态不会因为输出空间不足而丢失
+		if len(dst)-nDst < utf8.UTFMax || len(dst)-nDst < len(self.replacement) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		//3 个字节的输出中如果有 U+FFFD, 它就是唯一的字符; 4 个字节的字符需要更大的空间
+		n, m, decodeErr := self.decoder.Transform(buf[:3], src[nSrc:], atEOF)
+		if decodeErr == transform.ErrShortDst && n == 0 {
+			n, m, decodeErr = self.decoder.Transform(buf[:], src[nSrc:], atEOF)
+		}
+		out := buf[:n]
+		if r, size := utf8.DecodeRune(out); r == utf8.RuneError && size == 3 && !self.isGenuine(src[nSrc:nSrc+m]) {
+			out = []byte(self.replacement)
+		}
+		nDst += copy(dst[nDst:], out)
+		nSrc += m
+
+		switch decodeErr {
+		case nil, transform.ErrShortDst:
+			if n == 0 && m == 0 {
+				return nDst, nSrc, decodeErr
+			}
+		default:
+			return nDst, nSrc, decodeErr
+		}
+	}
+	return nDst, nSrc, nil
+}
+
+//解码为 U+FFFD 的原始字节是否就是 U+FFFD 的编码(UTF-16 的第一个字符可能带有 BOM)
+func (self *replaceInvalid) isGenuine(raw []byte) bool {
+	for _, g := range self.genuine {
+		if bytes.HasSuffix(raw, g) {
+			return true
+		}
+	}
+	return false
+}
+
+//把一段完整的数据(例如一行)转换为 UTF-8
+func (self *Charset) Decode(b []byte) []byte {
+	out, _, err := transform.Bytes(self.transformer(), b)
+	if err != nil {
+		return b
+	}
+	return out
+}
+
+//把数据流转换为 UTF-8, 用于在切分事件之前转换整个输入
+func (self *Charset) NewReader(r io.Reader) io.Reader {
+	return transform.NewReader(r, self.transformer())
+}
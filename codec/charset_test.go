@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCharsetWithBOM(t *testing.T) {
+	c, err := NewCharset("utf-16", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.Newline(), []byte{'\n', 0}) {
+		t.Fatalf("default newline %v", c.Newline())
+	}
+
+	//大端序的 BOM
+	be := []byte{0xfe, 0xff, 0, 'a', 0, 'b', 0, '\n'}
+	bc := c.WithBOM(be)
+	if !bytes.Equal(bc.Newline(), []byte{0, '\n'}) {
+		t.Fatalf("big endian newline %v", bc.Newline())
+	}
+	if out := string(bc.Decode(be[:6])); out != "ab" {
+		t.Fatalf("first line %q", out)
+	}
+	if out := string(bc.Decode([]byte{0, 'c', 0, '\n'})); out != "c\n" {
+		t.Fatalf("second line %q", out)
+	}
+
+	//没有 BOM 时不变
+	if c.WithBOM([]byte{'a', 0}) != c {
+		t.Fatal("charset changed without BOM")
+	}
+}
+
+func TestCharsetReplacement(t *testing.T) {
+	cases := []struct {
+		charset string
+		input   []byte
+		output  string
+	}{
+		//原有的 U+FFFD 保留, 无效的字节替换
+		{"utf-8", []byte("a\xef\xbf\xbdb\xffc"), "a�b?c"},
+		{"utf-8", []byte("\xe0\xef\xbf\xbd"), "?�"},
+		{"utf-16le", []byte{'a', 0, 0xfd, 0xff, 0x00, 0xd8, 'b', 0}, "a�?b"},
+		{"utf-16", []byte{0xfe, 0xff, 0xff, 0xfd, 0, 'x'}, "�x"},
+		{"gbk", []byte("\xc4\xe3\xff"), "你?"},
+		{"gb18030", []byte("\x84\x31\xa4\x37\xc4\xe3"), "�你"},
+		{"latin1", []byte("caf\xe9"), "café"},
+	}
+	for _, c := range cases {
+		charset, err := NewCharset(c.charset, "?")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := string(charset.Decode(c.input)); out != c.output {
+			t.Errorf("%s %x: got %q, expected %q", c.charset, c.input, out, c.output)
+		}
+		//数据流逐字节读取时结果相同
+		b, err := ioutil.ReadAll(charset.NewReader(iotest.OneByteReader(bytes.NewReader(c.input))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != c.output {
+			t.Errorf("%s %x stream: got %q, expected %q", c.charset, c.input, b, c.output)
+		}
+	}
+}
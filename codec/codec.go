@@ -0,0 +1,139 @@
+package codec
+
+import (
+	"bufio"
+	"errors"
+	p "github.com/domac/mafio/packet"
+	"io"
+)
+
+//*****************************************
+//
+// 编解码 (Codec)
+//
+// 输入插件通过解码器从数据流中切分并解析出事件,
+// 输出插件通过编码器把一批事件编码为要发送的数据
+//
+// 支持的编解码:
+//	line             每行一个事件, 事件内容为原始数据
+//	json             json 对象(输入可以是连续的多个对象或对象数组), 输出为一批事件组成的数组
+//	json_lines       每行一个 json 对象
+//	msgpack          连续的 msgpack map
+//	length_prefixed  4字节大端序长度 + 原始数据
+//	multiline        (仅输入) 按行读取, 再把连续的多行合并为一个事件, 见 multiline.go
+//
+//*****************************************
+
+const (
+	Line           = "line"
+	JSON           = "json"
+	JSONLines      = "json_lines"
+	Msgpack        = "msgpack"
+	LengthPrefixed = "length_prefixed"
+	Multiline      = "multiline"
+)
+
+//默认最大行长度
+const DefaultMaxLineSize = 1024 * 1024
+
+//超长的行会被截断, 同时返回该错误
+var ErrLineTooLong = errors.New("line too long, truncated")
+
+//解码器: 从数据流中逐个读取事件, 数据读完时返回 io.EOF
+type Decoder interface {
+	Decode() (*p.Packet, error)
+}
+
+//编码器: 把一批事件编码为输出数据
+type Encoder interface {
+	Encode(packets []*p.Packet) ([]byte, error)
+}
+
+func unknownCodec(name string) error {
+	return errors.New("unknown codec: " + name)
+}
+
+//根据名称创建解码器
+//maxSize 为单个事件的最大长度, 对 line、json_lines、msgpack 与 length_prefixed 有效
+func NewDecoder(name string, r io.Reader, maxSize int) (Decoder, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxLineSize
+	}
+	switch name {
+	case "", Line, Multiline:
+		return &lineDecoder{NewLineReader(r, maxSize)}, nil
+	case JSONLines:
+		return &jsonLinesDecoder{NewLineReader(r, maxSize)}, nil
+	case JSON:
+		return newJSONDecoder(r), nil
+	case Msgpack:
+		return &msgpackDecoder{reader: bufio.NewReader(r), maxSize: maxSize}, nil
+	case LengthPrefixed:
+		return &lengthPrefixedDecoder{reader: bufio.NewReader(r), maxSize: maxSize}, nil
+	}
+	return nil, unknownCodec(name)
+}
+
+//根据名称创建编码器
+func NewEncoder(name string) (Encoder, error) {
+	switch name {
+	case "", Line:
+		return lineEncoder{}, nil
+	case JSON:
+		return jsonEncoder{}, nil
+	case JSONLines:
+		return jsonLinesEncoder{}, nil
+	case Msgpack:
+		return msgpackEncoder{}, nil
+	case LengthPrefixed:
+		return lengthPrefixedEncoder{}, nil
+	}
+	return nil, unknownCodec(name)
+}
+
+//按编解码把一行数据转换为事件
+//用于按行切分的输入(例如文件), 只支持 line、json、json_lines 与 multiline
+func DecodeLine(name string, line []byte) (*p.Packet, error) {
+	switch name {
+	case "", Line, Multiline:
+		return p.NewPacket(line), nil
+	case JSON, JSONLines:
+		return DecodeJSON(line), nil
+	}
+	return nil, errors.New("codec " + name + " can't decode lines")
+}
+
+//事件的结构化表示, 用于 json 与 msgpack 编码
+//包括事件字段, message 为原始数据(字段中已有 message 时不覆盖), tags 为标签
+func EventMap(pkt *p.Packet) map[string]interface{} {
+	m := make(map[string]interface{}, len(pkt.Fields)+2)
+	for k, v := range pkt.Fields {
+		m[k] = v
+	}
+	if _, ok := m[p.FieldMessage]; !ok {
+		m[p.FieldMessage] = string(pkt.Data)
+	}
+	if len(pkt.Tags) > 0 {
+		m["tags"] = pkt.Tags
+	}
+	return m
+}
+
+//把结构化数据转换为事件
+//message 字段作为原始数据, 没有 message 时使用 raw; tags 转换为事件标签
+func packetFromMap(m map[string]interface{}, raw []byte) *p.Packet {
+	pkt := p.NewPacket(raw)
+	if msg, ok := m[p.FieldMessage].(string); ok {
+		pkt.Data = []byte(msg)
+	}
+	if tags, ok := m["tags"].([]interface{}); ok {
+		delete(m, "tags")
+		for _, t := range tags {
+			if s, ok := t.(string); ok {
+				pkt.AddTag(s)
+			}
+		}
+	}
+	pkt.Fields = m
+	return pkt
+}
@@ -0,0 +1,166 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	m "github.com/rcrowley/go-metrics"
+	"io"
+	"strings"
+)
+
+//输出压缩
+//输出插件把编码后的一批事件压缩为一个完整的压缩帧再发送或写入, 支持:
+//
+//	none    不压缩
+//	gzip    Content-Encoding: gzip
+//	snappy  snappy 分帧格式, Content-Encoding: x-snappy-framed
+//	lz4     lz4 帧格式, Content-Encoding: x-lz4
+//	zstd    Content-Encoding: zstd
+//
+//各格式的帧都可以直接拼接, 多个批次追加写入同一个文件后仍然可以用 gzip/snzip/lz4/zstd 命令解压
+//
+//压缩前后的字节数与压缩比记录在全局的 metrics 中:
+//	compress.<输出插件>.bytes_in   压缩前的字节数
+//	compress.<输出插件>.bytes_out  压缩后的字节数
+//	compress.<输出插件>.ratio      累计的压缩比(压缩前/压缩后)
+//
+//输入插件可以按 magic 识别 gzip 与 zstd 压缩的数据并解压读取, 例如轮转后压缩的 app.log.3.gz
+
+const (
+	CompressNone   = "none"
+	CompressGzip   = "gzip"
+	CompressSnappy = "snappy"
+	CompressLZ4    = "lz4"
+	CompressZstd   = "zstd"
+)
+
+//压缩器, 可以在多个协程中使用
+type Compressor struct {
+	name     string
+	encoding string
+	compress func(b []byte) ([]byte, error)
+
+	bytesIn  m.Counter
+	bytesOut m.Counter
+	ratio    m.GaugeFloat64
+}
+
+//根据名称创建压缩器, 名称为空时不压缩
+//metricName 一般为输出插件名, 用于区分各插件的压缩统计
+func NewCompressor(name, metricName string) (*Compressor, error) {
+	c := &Compressor{name: strings.ToLower(name)}
+
+	switch c.name {
+	case "", CompressNone:
+		c.name = CompressNone
+		return c, nil
+	case CompressGzip:
+		c.encoding = "gzip"
+		c.compress = gzipCompress
+	case CompressSnappy:
+		c.encoding = "x-snappy-framed"
+		c.compress = snappyCompress
+	case CompressLZ4:
+		c.encoding = "x-lz4"
+		c.compress = LZ4Compress
+	case CompressZstd:
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		c.encoding = "zstd"
+		c.compress = func(b []byte) ([]byte, error) {
+			return encoder.EncodeAll(b, nil), nil
+		}
+	default:
+		return nil, errors.New("unknown compression: " + name)
+	}
+
+	prefix := "compress." + metricName + "."
+	c.bytesIn = m.GetOrRegisterCounter(prefix+"bytes_in", m.DefaultRegistry)
+	c.bytesOut = m.GetOrRegisterCounter(prefix+"bytes_out", m.DefaultRegistry)
+	c.ratio = m.GetOrRegisterGaugeFloat64(prefix+"ratio", m.DefaultRegistry)
+	return c, nil
+}
+
+func (self *Compressor) Name() string {
+	return self.name
+}
+
+//对应的 Content-Encoding, 不压缩时为空
+func (self *Compressor) ContentEncoding() string {
+	return self.encoding
+}
+
+//压缩一批数据, 不压缩时原样返回
+func (self *Compressor) Compress(b []byte) ([]byte, error) {
+	if self.compress == nil {
+		return b, nil
+	}
+	out, err := self.compress(b)
+	if err != nil {
+		return nil, err
+	}
+
+	self.bytesIn.Inc(int64(len(b)))
+	self.bytesOut.Inc(int64(len(out)))
+	if n := self.bytesOut.Count(); n > 0 {
+		self.ratio.Update(float64(self.bytesIn.Count()) / float64(n))
+	}
+	return out, nil
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func snappyCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := s2.NewWriter(&buf, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+	if err := w.EncodeBuffer(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+//根据数据开头的 magic 判断压缩格式, 不是 gzip 或 zstd 时返回空
+func DetectCompression(b []byte) string {
+	switch {
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		return CompressGzip
+	case bytes.HasPrefix(b, zstdMagic):
+		return CompressZstd
+	}
+	return ""
+}
+
+//解压读取 gzip 或 zstd 压缩的数据
+func NewDecompressReader(r io.Reader, name string) (io.ReadCloser, error) {
+	switch name {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errors.New("unknown compression: " + name)
+}
@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	p "github.com/domac/mafio/packet"
+	"io"
+)
+
+//json 解析失败的事件会带上该标签, 原始数据保留在 Data 中
+const TagJSONParseFailure = "_jsonparsefailure"
+
+//json 行, 空行会被跳过
+type jsonLinesDecoder struct {
+	lr *LineReader
+}
+
+func (self *jsonLinesDecoder) Decode() (*p.Packet, error) {
+	for {
+		line, err := self.lr.ReadLine()
+		if err != nil && err != ErrLineTooLong {
+			return nil, err
+		}
+		if len(bytes.TrimSpace(line)) == 0 && err == nil {
+			continue
+		}
+		return DecodeJSON(line), err
+	}
+}
+
+//把一个json对象转换为事件
+//对象的字段写入事件字段, message 字段作为原始数据, 没有 message 时保留整个对象
+//解析失败时事件带上 _jsonparsefailure 标签
+func DecodeJSON(data []byte) *p.Packet {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		pkt := p.NewPacket(data)
+		pkt.AddTag(TagJSONParseFailure)
+		return pkt
+	}
+	return packetFromMap(fields, data)
+}
+
+//连续的 json 值, 对象数组会拆分为多个事件
+type jsonDecoder struct {
+	decoder *json.Decoder
+	pending []json.RawMessage
+}
+
+func newJSONDecoder(r io.Reader) *jsonDecoder {
+	return &jsonDecoder{decoder: json.NewDecoder(bufio.NewReader(r))}
+}
+
+func (self *jsonDecoder) Decode() (*p.Packet, error) {
+	for len(self.pending) == 0 {
+		var raw json.RawMessage
+		if err := self.decoder.Decode(&raw); err != nil {
+			return nil, err
+		}
+		raw = bytes.TrimSpace(raw)
+		if len(raw) > 0 && raw[0] == '[' {
+			if err := json.Unmarshal(raw, &self.pending); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		self.pending = append(self.pending, raw)
+	}
+	raw := self.pending[0]
+	self.pending = self.pending[1:]
+
+	//字符串直接作为原始数据
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return p.NewPacket([]byte(s)), nil
+	}
+	return DecodeJSON(raw), nil
+}
+
+//一批事件编码为一个 json 数组
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(packets []*p.Packet) ([]byte, error) {
+	events := make([]map[string]interface{}, 0, len(packets))
+	for _, pkt := range packets {
+		events = append(events, EventMap(pkt))
+	}
+	return json.Marshal(events)
+}
+
+//每个事件编码为一行 json
+type jsonLinesEncoder struct{}
+
+func (jsonLinesEncoder) Encode(packets []*p.Packet) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for _, pkt := range packets {
+		b, err := json.Marshal(EventMap(pkt))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
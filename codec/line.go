@@ -0,0 +1,92 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	p "github.com/domac/mafio/packet"
+	"io"
+)
+
+//按行读取, 去掉行尾的 \r\n
+//超过最大长度的行只保留前 maxLineSize 个字节, 剩余部分丢弃
+type LineReader struct {
+	reader      *bufio.Reader
+	maxLineSize int
+}
+
+func NewLineReader(r io.Reader, maxLineSize int) *LineReader {
+	return &LineReader{
+		reader:      bufio.NewReader(r),
+		maxLineSize: maxLineSize,
+	}
+}
+
+//读取一行, 最后一行没有换行符时同样返回
+func (self *LineReader) ReadLine() ([]byte, error) {
+	var (
+		line    []byte
+		size    int
+		newline bool
+	)
+	for {
+		fragment, err := self.reader.ReadSlice('\n')
+		size += len(fragment)
+		newline = len(fragment) > 0 && fragment[len(fragment)-1] == '\n'
+		if room := self.maxLineSize + 2 - len(line); room > 0 {
+			if len(fragment) > room {
+				fragment = fragment[:room]
+			}
+			line = append(line, fragment...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || size == 0) {
+			return nil, err
+		}
+		break
+	}
+
+	//行尾的换行符不计入长度
+	if newline {
+		size--
+		line = bytes.TrimSuffix(line, []byte("\n"))
+	}
+	if bytes.HasSuffix(line, []byte("\r")) && len(line) <= self.maxLineSize+1 {
+		size--
+		line = line[:len(line)-1]
+	}
+	if size > self.maxLineSize {
+		return line[:self.maxLineSize], ErrLineTooLong
+	}
+	return line, nil
+}
+
+//纯文本行
+type lineDecoder struct {
+	lr *LineReader
+}
+
+func (self *lineDecoder) Decode() (*p.Packet, error) {
+	line, err := self.lr.ReadLine()
+	if err != nil && err != ErrLineTooLong {
+		return nil, err
+	}
+	return p.NewPacket(line), err
+}
+
+//纯文本行编码, 每个事件一行
+type lineEncoder struct{}
+
+func (lineEncoder) Encode(packets []*p.Packet) ([]byte, error) {
+	size := 0
+	for _, pkt := range packets {
+		size += len(pkt.Data) + 1
+	}
+	b := make([]byte, 0, size)
+	for _, pkt := range packets {
+		b = append(b, pkt.Data...)
+		b = append(b, '\n')
+	}
+	return b, nil
+}
@@ -0,0 +1,25 @@
+package codec
+
+import (
+	"bytes"
+	"github.com/pierrec/lz4"
+)
+
+//lz4 帧格式压缩
+//每 64KB 为一个独立的块, 带内容校验, 可以用 lz4 -d 命令解压
+
+const lz4BlockSize = 64 * 1024
+
+//把数据压缩为一个完整的 lz4 帧
+func LZ4Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	w.Header = lz4.Header{BlockMaxSize: lz4BlockSize}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
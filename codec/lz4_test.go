@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pierrec/lz4"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+//可压缩的日志样式数据
+func lz4TestText(n int) []byte {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "2026-10-19 12:00:%02d host%d GET /api/v1/items/%d 200 %dms\n", rnd.Intn(60), rnd.Intn(4), rnd.Intn(1000), rnd.Intn(300))
+	}
+	return b.Bytes()[:n]
+}
+
+func lz4TestRandom(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func lz4TestData() [][]byte {
+	return [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("abcd"), 25),
+		lz4TestText(lz4BlockSize + 1),
+		bytes.Repeat([]byte{'x'}, 3*lz4BlockSize),
+		lz4TestRandom(lz4BlockSize),
+		lz4TestText(5*lz4BlockSize + 100),
+	}
+}
+
+func TestLZ4RoundTrip(t *testing.T) {
+	for _, data := range lz4TestData() {
+		frame, err := LZ4Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(lz4.NewReader(bytes.NewReader(frame)))
+		if err != nil {
+			t.Fatalf("decode %d bytes: %s", len(data), err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("round trip mismatch, %d bytes in, %d bytes out", len(data), len(out))
+		}
+	}
+
+	//重复的数据应该被压缩
+	frame, _ := LZ4Compress(bytes.Repeat([]byte{'x'}, lz4BlockSize))
+	if len(frame) > 512 {
+		t.Errorf("long match compressed to %d bytes", len(frame))
+	}
+}
+
+//与 lz4 命令行工具互相验证, 多个帧拼接后也能解压, 没有安装时跳过
+func TestLZ4Command(t *testing.T) {
+	command, err := exec.LookPath("lz4")
+	if err != nil {
+		t.Skip("lz4 command not found")
+	}
+	var frames, expected []byte
+	for _, data := range lz4TestData() {
+		frame, err := LZ4Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame...)
+		expected = append(expected, data...)
+	}
+	cmd := exec.Command(command, "-d", "-c")
+	cmd.Stdin = bytes.NewReader(frames)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("lz4 -d failed: %s", err)
+	}
+	if !bytes.Equal(out, expected) {
+		t.Fatalf("lz4 -d output mismatch, %d bytes in, %d bytes out", len(expected), len(out))
+	}
+}
@@ -0,0 +1,404 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	p "github.com/domac/mafio/packet"
+	"io"
+	"math"
+	"reflect"
+)
+
+//msgpack 编解码
+//事件编码为 map, 一批事件依次连续写出; 解码时每个 map 为一个事件
+//只实现事件数据用到的类型: nil、bool、整数、浮点数、字符串、二进制、数组与 map
+
+var (
+	errMsgpackFormat   = errors.New("invalid msgpack data")
+	errMsgpackTooLarge = errors.New("msgpack event exceeds max size")
+)
+
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) Encode(packets []*p.Packet) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	for _, pkt := range packets {
+		if b, err = appendMsgpack(b, EventMap(pkt)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendMsgpackLen(b []byte, n int, fix, fixMax byte, code16, code32 byte) []byte {
+	switch {
+	case fixMax > 0 && n <= int(fixMax):
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, code16)
+		return appendUint16(b, uint16(n))
+	default:
+		b = append(b, code32)
+		return appendUint32(b, uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	if len(s) <= 31 {
+		b = append(b, 0xa0|byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		b = append(b, 0xd9, byte(len(s)))
+	} else {
+		b = appendMsgpackLen(b, len(s), 0, 0, 0xda, 0xdb)
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= 127:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		return appendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		return appendUint32(append(b, 0xd2), uint32(i))
+	}
+	return appendUint64(append(b, 0xd3), uint64(i))
+}
+
+func appendMsgpack(b []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if x {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case string:
+		return appendMsgpackString(b, x), nil
+	case []byte:
+		if len(x) <= math.MaxUint8 {
+			b = append(b, 0xc4, byte(len(x)))
+		} else {
+			b = appendMsgpackLen(b, len(x), 0, 0, 0xc5, 0xc6)
+		}
+		return append(b, x...), nil
+	case float32:
+		return appendUint32(append(b, 0xca), math.Float32bits(x)), nil
+	case float64:
+		//json 中的整数也是 float64, 能精确表示的按整数编码
+		if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+			return appendMsgpackInt(b, int64(x)), nil
+		}
+		return appendUint64(append(b, 0xcb), math.Float64bits(x)), nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpack(b, f)
+	case []string:
+		b = appendMsgpackLen(b, len(x), 0x90, 15, 0xdc, 0xdd)
+		for _, s := range x {
+			b = appendMsgpackString(b, s)
+		}
+		return b, nil
+	case []interface{}:
+		b = appendMsgpackLen(b, len(x), 0x90, 15, 0xdc, 0xdd)
+		var err error
+		for _, e := range x {
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		b = appendMsgpackLen(b, len(x), 0x80, 15, 0xde, 0xdf)
+		var err error
+		for k, e := range x {
+			b = appendMsgpackString(b, k)
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]string:
+		b = appendMsgpackLen(b, len(x), 0x80, 15, 0xde, 0xdf)
+		for k, e := range x {
+			b = appendMsgpackString(appendMsgpackString(b, k), e)
+		}
+		return b, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u <= math.MaxInt64 {
+			return appendMsgpackInt(b, int64(u)), nil
+		}
+		return appendUint64(append(b, 0xcf), u), nil
+	}
+	//其它类型按字符串编码
+	return appendMsgpackString(b, fmt.Sprint(v)), nil
+}
+
+type msgpackDecoder struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func (self *msgpackDecoder) Decode() (*p.Packet, error) {
+	//每个事件最多读取 maxSize 个字节
+	r := &msgpackReader{reader: self.reader, remain: self.maxSize}
+	v, err := r.read(0)
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		raw, _ := json.Marshal(x)
+		return packetFromMap(x, raw), nil
+	case string:
+		return p.NewPacket([]byte(x)), nil
+	case []byte:
+		return p.NewPacket(x), nil
+	}
+	return p.NewPacket([]byte(fmt.Sprint(v))), nil
+}
+
+func readN(r *bufio.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+//msgpack 值的最大嵌套层数
+const maxMsgpackDepth = 64
+
+//读取一个事件的 msgpack 数据
+//数据中的长度与元素个数不可信, 分配内存之前先检查是否超出剩余的字节数(remain)
+type msgpackReader struct {
+	reader *bufio.Reader
+	remain int
+}
+
+func (self *msgpackReader) readByte() (byte, error) {
+	if self.remain < 1 {
+		return 0, errMsgpackTooLarge
+	}
+	c, err := self.reader.ReadByte()
+	if err == nil {
+		self.remain--
+	}
+	return c, err
+}
+
+func (self *msgpackReader) readN(n uint64) ([]byte, error) {
+	if n > uint64(self.remain) {
+		return nil, errMsgpackTooLarge
+	}
+	self.remain -= int(n)
+	return readN(self.reader, int(n))
+}
+
+func (self *msgpackReader) readUint(size int) (uint64, error) {
+	b, err := self.readN(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+//检查数组或 map 的元素个数, 每个元素至少占用 1 个字节(map 为 2 个)
+func (self *msgpackReader) checkCount(n uint64, width uint64) error {
+	if n*width > uint64(self.remain) {
+		return errMsgpackTooLarge
+	}
+	return nil
+}
+
+//读取一个 msgpack 值, 数据流结束时返回 io.EOF
+func (self *msgpackReader) read(depth int) (interface{}, error) {
+	c, err := self.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return self.readMap(uint64(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return self.readArray(uint64(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		b, err := self.readN(uint64(c & 0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		sizes := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}
+		n, err := self.readUint(sizes[c])
+		if err != nil {
+			return nil, err
+		}
+		b, err := self.readN(n)
+		if err != nil || c <= 0xc6 {
+			return b, err
+		}
+		return string(b), nil
+	case 0xca:
+		u, err := self.readUint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := self.readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := self.readUint(1 << (c - 0xcc))
+		return u, err
+	case 0xd0:
+		u, err := self.readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := self.readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := self.readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := self.readUint(8)
+		return int64(u), err
+	case 0xdc, 0xdd:
+		n, err := self.readUint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return self.readArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := self.readUint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return self.readMap(n, depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		//扩展类型按二进制返回
+		var n uint64
+		if c >= 0xd4 {
+			n = 1 << (c - 0xd4)
+		} else if n, err = self.readUint(1 << (c - 0xc7)); err != nil {
+			return nil, err
+		}
+		b, err := self.readN(n + 1)
+		if err != nil {
+			return nil, err
+		}
+		return b[1:], nil
+	}
+	return nil, errMsgpackFormat
+}
+
+func (self *msgpackReader) readArray(n uint64, depth int) ([]interface{}, error) {
+	if depth >= maxMsgpackDepth {
+		return nil, errMsgpackFormat
+	}
+	if err := self.checkCount(n, 1); err != nil {
+		return nil, err
+	}
+	arr := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := self.read(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (self *msgpackReader) readMap(n uint64, depth int) (map[string]interface{}, error) {
+	if depth >= maxMsgpackDepth {
+		return nil, errMsgpackFormat
+	}
+	if err := self.checkCount(n, 2); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := self.read(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		v, err := self.read(depth + 1)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		switch key := k.(type) {
+		case string:
+			m[key] = v
+		case []byte:
+			m[string(key)] = v
+		default:
+			m[fmt.Sprint(key)] = v
+		}
+	}
+	return m, nil
+}
+
+//值读到一半时数据结束
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
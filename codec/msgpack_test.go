@@ -0,0 +1,134 @@
+package codec
+
+import (
+	"bytes"
+	p "github.com/domac/mafio/packet"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func decodeAll(t *testing.T, data []byte, maxSize int) ([]*p.Packet, error) {
+	decoder, err := NewDecoder(Msgpack, bytes.NewReader(data), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []*p.Packet
+	for {
+		pkt, err := decoder.Decode()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, pkt)
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 70000))
+	pkt := p.NewPacket([]byte("hello"))
+	pkt.SetField("status", 200)
+	pkt.SetField("cost", 1.5)
+	pkt.SetField("negative", -100000)
+	pkt.SetField("big", uint64(1)<<63)
+	pkt.SetField("ok", true)
+	pkt.SetField("none", nil)
+	pkt.SetField("long", long)
+	pkt.SetField("list", []interface{}{"a", 1.0, false})
+	pkt.SetField("nested", map[string]interface{}{"k": "v"})
+	pkt.AddTag("t1")
+	pkt.AddTag("t2")
+
+	data, err := msgpackEncoder{}.Encode([]*p.Packet{pkt, p.NewPacket([]byte("second"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := decodeAll(t, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+
+	got := packets[0]
+	if string(got.Data) != "hello" || !reflect.DeepEqual(got.Tags, []string{"t1", "t2"}) {
+		t.Fatalf("unexpected packet %q %v", got.Data, got.Tags)
+	}
+	expected := map[string]interface{}{
+		"message":  "hello",
+		"status":   int64(200),
+		"cost":     1.5,
+		"negative": int64(-100000),
+		"big":      uint64(1) << 63,
+		"ok":       true,
+		"none":     nil,
+		"long":     long,
+		"list":     []interface{}{"a", int64(1), false},
+		"nested":   map[string]interface{}{"k": "v"},
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(got.Fields[k], v) {
+			t.Errorf("field %s: got %#v, expected %#v", k, got.Fields[k], v)
+		}
+	}
+	if string(packets[1].Data) != "second" {
+		t.Fatalf("unexpected second packet %q", packets[1].Data)
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	pkt := p.NewPacket([]byte("hello"))
+	pkt.SetField("list", []interface{}{"a", 1.0, 1.5})
+	pkt.SetField("bin", []byte("abc"))
+	data, err := msgpackEncoder{}.Encode([]*p.Packet{pkt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(data); i++ {
+		if _, err := decodeAll(t, data[:i], 0); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d/%d: got %v", i, len(data), err)
+		}
+	}
+}
+
+func TestMsgpackHostile(t *testing.T) {
+	cases := map[string][]byte{
+		"bin32":    {0xc6, 0xff, 0xff, 0xff, 0xff},
+		"str32":    {0xdb, 0xff, 0xff, 0xff, 0xff, 'a'},
+		"array32":  {0xdd, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"map32":    {0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 'k', 0x01},
+		"ext32":    {0xc9, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"array16":  {0xdc, 0xff, 0xff, 0x01, 0x02},
+		"overflow": append([]byte{0xdb, 0x00, 0x00, 0x00, 0x20}, bytes.Repeat([]byte("a"), 32)...),
+	}
+	for name, data := range cases {
+		packets, err := decodeAll(t, data, 16)
+		if err == nil {
+			t.Errorf("%s: expected an error, got %d packets", name, len(packets))
+		}
+	}
+
+	//嵌套层数过多
+	if _, err := decodeAll(t, bytes.Repeat([]byte{0x91}, 100000), 0); err != errMsgpackFormat {
+		t.Errorf("nested: got %v", err)
+	}
+
+	//长度在限制之内但数据不完整
+	if _, err := decodeAll(t, []byte{0xdb, 0x00, 0x00, 0x00, 0x08, 'a'}, 16); err != io.ErrUnexpectedEOF {
+		t.Errorf("short str32: got %v", err)
+	}
+}
+
+//随机数据只能返回错误, 不能 panic 或者按数据中的长度分配内存
+func TestMsgpackRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 64)
+	for i := 0; i < 20000; i++ {
+		rnd.Read(data)
+		decodeAll(t, data, 1024)
+	}
+}
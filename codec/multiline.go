@@ -0,0 +1,175 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	p "github.com/domac/mafio/packet"
+	"regexp"
+	"time"
+)
+
+//多行合并 (codec: multiline)
+//按行读取后, 由输入插件把连续的多行(例如 java 异常堆栈、go panic)合并为一个事件, 配置格式:
+//
+//	"multiline": {
+//	  "pattern": "^\\s",      行匹配的正则
+//	  "negate": false,        为 true 时不匹配 pattern 的行才算匹配
+//	  "what": "previous",     匹配的行归属上一行(previous)或下一行(next)
+//	  "max_lines": 500,       单个事件最多的行数
+//	  "max_bytes": 10485760,  单个事件最大的字节数
+//	  "timeout": 5            等待后续行的时间(秒), 超时后输出已合并的行
+//	}
+//
+//合并后的事件带有 multiline 标签, 超过行数或字节数限制被拆分的事件带有 multiline_truncated 标签
+
+const (
+	TagMultiline          = "multiline"
+	TagMultilineTruncated = "multiline_truncated"
+)
+
+const (
+	defaultMultilineMaxLines = 500
+	defaultMultilineMaxBytes = 10 * 1024 * 1024
+	defaultMultilineTimeout  = 5 * time.Second
+)
+
+//多行合并器
+//每个数据流(例如每个文件)各自使用一个, 不能在多个协程中共享
+type MultilineAssembler struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	next     bool
+	maxLines int
+	maxBytes int
+	timeout  time.Duration
+
+	buffer    bytes.Buffer
+	lines     int
+	truncated bool
+	lastPush  time.Time
+}
+
+//根据插件配置中的 multiline 项创建合并器
+func NewMultilineAssembler(conf map[string]interface{}) (*MultilineAssembler, error) {
+	if conf == nil {
+		return nil, errors.New("multiline config not found")
+	}
+	pattern, _ := conf["pattern"].(string)
+	if pattern == "" {
+		return nil, errors.New("multiline config-pattern not found")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("multiline pattern %q - %s", pattern, err)
+	}
+
+	m := &MultilineAssembler{
+		pattern:  re,
+		maxLines: defaultMultilineMaxLines,
+		maxBytes: defaultMultilineMaxBytes,
+		timeout:  defaultMultilineTimeout,
+	}
+	m.negate, _ = conf["negate"].(bool)
+	switch what, _ := conf["what"].(string); what {
+	case "", "previous":
+	case "next":
+		m.next = true
+	default:
+		return nil, fmt.Errorf("multiline what must be previous or next, got %q", what)
+	}
+	if v, ok := conf["max_lines"].(float64); ok && v > 0 {
+		m.maxLines = int(v)
+	}
+	if v, ok := conf["max_bytes"].(float64); ok && v > 0 {
+		m.maxBytes = int(v)
+	}
+	if v, ok := conf["timeout"].(float64); ok && v > 0 {
+		m.timeout = time.Duration(v * float64(time.Second))
+	}
+	return m, nil
+}
+
+//等待后续行的超时时间
+func (self *MultilineAssembler) Timeout() time.Duration {
+	return self.timeout
+}
+
+//是否有尚未输出的行
+func (self *MultilineAssembler) Pending() bool {
+	return self.lines > 0
+}
+
+//等待后续行超时时, 输出已合并的行, 否则返回 nil
+//输入插件按 Timeout() 的一半左右定期调用
+func (self *MultilineAssembler) FlushExpired() *p.Packet {
+	if self.lines == 0 || time.Since(self.lastPush) < self.timeout {
+		return nil
+	}
+	return self.Flush()
+}
+
+//定期检查超时的间隔
+func (self *MultilineAssembler) CheckInterval() time.Duration {
+	interval := self.timeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+//加入一行, 返回已经合并完成的事件
+func (self *MultilineAssembler) Push(line []byte) []*p.Packet {
+	var events []*p.Packet
+	self.lastPush = time.Now()
+
+	//超过限制时先输出已合并的部分
+	if self.lines > 0 && (self.lines >= self.maxLines || self.buffer.Len()+1+len(line) > self.maxBytes) {
+		self.truncated = true
+		events = append(events, self.Flush())
+	}
+
+	matched := self.pattern.Match(line) != self.negate
+	if !self.next && !matched && self.lines > 0 {
+		//上一个事件结束, 当前行开始新的事件
+		events = append(events, self.Flush())
+	}
+
+	self.append(line)
+
+	if self.next && !matched {
+		//当前行是事件的最后一行
+		events = append(events, self.Flush())
+	}
+	return events
+}
+
+func (self *MultilineAssembler) append(line []byte) {
+	if self.lines > 0 {
+		self.buffer.WriteByte('\n')
+	}
+	if room := self.maxBytes - self.buffer.Len(); len(line) > room {
+		line = line[:room]
+		self.truncated = true
+	}
+	self.buffer.Write(line)
+	self.lines++
+}
+
+//输出已合并的行, 没有时返回 nil
+func (self *MultilineAssembler) Flush() *p.Packet {
+	if self.lines == 0 {
+		return nil
+	}
+	pkt := p.NewPacket(append([]byte(nil), self.buffer.Bytes()...))
+	if self.lines > 1 {
+		pkt.AddTag(TagMultiline)
+	}
+	if self.truncated {
+		pkt.AddTag(TagMultilineTruncated)
+	}
+	self.buffer.Reset()
+	self.lines = 0
+	self.truncated = false
+	return pkt
+}
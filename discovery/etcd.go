@@ -0,0 +1,214 @@
+package discovery
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//*****************************************
+//
+// etcd v3 客户端
+//
+// 通过 etcd 的 grpc-gateway (json over http) 接口访问,
+// 不依赖 grpc, 支持多个 endpoint 轮流尝试
+//
+//*****************************************
+
+var ErrLeaseExpired = errors.New("etcd lease expired")
+
+type EtcdClient struct {
+	Endpoints  []string
+	APIPrefix  string //etcd 3.4+ 为 /v3, 3.3 为 /v3beta
+	httpClient *http.Client
+}
+
+//创建客户端
+//endpoint 可以是 host:port 或者 http(s)://host:port
+func NewEtcdClient(endpoints []string, timeout time.Duration) *EtcdClient {
+	eps := []string{}
+	for _, ep := range endpoints {
+		ep = strings.TrimRight(strings.TrimSpace(ep), "/")
+		if ep == "" {
+			continue
+		}
+		if !strings.HasPrefix(ep, "http://") && !strings.HasPrefix(ep, "https://") {
+			ep = "http://" + ep
+		}
+		eps = append(eps, ep)
+	}
+	return &EtcdClient{
+		Endpoints:  eps,
+		APIPrefix:  "/v3",
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+//调用 gateway 接口, 依次尝试各个 endpoint
+func (c *EtcdClient) call(path string, req interface{}, resp interface{}) (err error) {
+	if len(c.Endpoints) == 0 {
+		return errors.New("no etcd endpoint")
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for _, ep := range c.Endpoints {
+		if err = c.callEndpoint(ep+c.APIPrefix+path, body, resp); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (c *EtcdClient) callEndpoint(url string, body []byte, resp interface{}) error {
+	r, err := c.httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("etcd %s: %s %s", url, r.Status, strings.TrimSpace(string(b)))
+	}
+	//keepalive 等流式接口的结果包在 result 中
+	wrapper := struct {
+		Result json.RawMessage `json:"result"`
+	}{}
+	if json.Unmarshal(b, &wrapper) == nil && len(wrapper.Result) > 0 {
+		b = wrapper.Result
+	}
+	return json.Unmarshal(b, resp)
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+//gateway 中 int64 以字符串形式返回
+type int64String string
+
+func (s int64String) Int64() int64 {
+	i, _ := strconv.ParseInt(string(s), 10, 64)
+	return i
+}
+
+//申请租约
+func (c *EtcdClient) Grant(ttl int64) (leaseID int64, err error) {
+	resp := struct {
+		ID    int64String `json:"ID"`
+		TTL   int64String `json:"TTL"`
+		Error string      `json:"error"`
+	}{}
+	if err = c.call("/lease/grant", map[string]interface{}{"TTL": ttl}, &resp); err != nil {
+		return
+	}
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	return resp.ID.Int64(), nil
+}
+
+//续约, 租约已经失效时返回 ErrLeaseExpired
+func (c *EtcdClient) KeepAliveOnce(leaseID int64) error {
+	resp := struct {
+		TTL int64String `json:"TTL"`
+	}{}
+	if err := c.call("/lease/keepalive", map[string]interface{}{"ID": strconv.FormatInt(leaseID, 10)}, &resp); err != nil {
+		return err
+	}
+	if resp.TTL.Int64() <= 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+//撤销租约, 绑定在租约上的 key 会被删除
+func (c *EtcdClient) Revoke(leaseID int64) error {
+	resp := map[string]interface{}{}
+	return c.call("/lease/revoke", map[string]interface{}{"ID": strconv.FormatInt(leaseID, 10)}, &resp)
+}
+
+//写入 key, leaseID 为0时不绑定租约
+func (c *EtcdClient) Put(key, value string, leaseID int64) error {
+	req := map[string]interface{}{
+		"key":   b64(key),
+		"value": b64(value),
+	}
+	if leaseID != 0 {
+		req["lease"] = strconv.FormatInt(leaseID, 10)
+	}
+	resp := map[string]interface{}{}
+	return c.call("/kv/put", req, &resp)
+}
+
+//键值对
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+//按前缀读取
+func (c *EtcdClient) GetPrefix(prefix string) ([]*KeyValue, error) {
+	return c.rangeKeys(map[string]interface{}{
+		"key":       b64(prefix),
+		"range_end": b64(prefixEnd(prefix)),
+	})
+}
+
+func (c *EtcdClient) rangeKeys(req map[string]interface{}) ([]*KeyValue, error) {
+	resp := struct {
+		Kvs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	if err := c.call("/kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+	kvs := make([]*KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		k, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, &KeyValue{Key: string(k), Value: v})
+	}
+	return kvs, nil
+}
+
+//读取单个 key, 不存在时返回 nil
+func (c *EtcdClient) Get(key string) (*KeyValue, error) {
+	kvs, err := c.rangeKeys(map[string]interface{}{"key": b64(key)})
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	return kvs[0], nil
+}
+
+//前缀查询的结束 key: 最后一个非0xff字节加1
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	//全是0xff时表示读取到末尾
+	return "\x00"
+}
@@ -0,0 +1,261 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//etcd v3 gateway 的本地替身, 只实现注册与查询用到的接口
+type fakeEtcd struct {
+	*httptest.Server
+
+	lock      sync.Mutex
+	nextLease int64
+	leases    map[int64]int64 //租约 -> TTL
+	kvs       map[string]fakeValue
+	calls     map[string]int
+}
+
+type fakeValue struct {
+	value string
+	lease int64
+}
+
+func newFakeEtcd() *fakeEtcd {
+	f := &fakeEtcd{
+		nextLease: 0x100,
+		leases:    map[int64]int64{},
+		kvs:       map[string]fakeValue{},
+		calls:     map[string]int{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/lease/grant", f.grant)
+	mux.HandleFunc("/v3/lease/keepalive", f.keepalive)
+	mux.HandleFunc("/v3/lease/revoke", f.revoke)
+	mux.HandleFunc("/v3/kv/put", f.put)
+	mux.HandleFunc("/v3/kv/range", f.rangeKeys)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeEtcd) client() *EtcdClient {
+	return NewEtcdClient([]string{f.URL}, time.Second)
+}
+
+func (f *fakeEtcd) count(path string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[path]
+}
+
+func (f *fakeEtcd) value(key string) (fakeValue, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	v, ok := f.kvs[key]
+	return v, ok
+}
+
+//模拟租约过期: 删除租约以及绑定的 key
+func (f *fakeEtcd) expire(lease int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropLease(lease)
+}
+
+func (f *fakeEtcd) dropLease(lease int64) {
+	delete(f.leases, lease)
+	for k, v := range f.kvs {
+		if v.lease == lease {
+			delete(f.kvs, k)
+		}
+	}
+}
+
+func (f *fakeEtcd) decode(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	f.lock.Lock()
+	f.calls[r.URL.Path]++
+	f.lock.Unlock()
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, resp interface{}) {
+	json.NewEncoder(w).Encode(resp)
+}
+
+func unb64(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+func (f *fakeEtcd) grant(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		TTL int64 `json:"TTL"`
+	}{}
+	if !f.decode(w, r, &req) {
+		return
+	}
+	f.lock.Lock()
+	f.nextLease++
+	id := f.nextLease
+	f.leases[id] = req.TTL
+	f.lock.Unlock()
+	reply(w, map[string]string{"ID": strconv.FormatInt(id, 10), "TTL": strconv.FormatInt(req.TTL, 10)})
+}
+
+func (f *fakeEtcd) keepalive(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID int64String `json:"ID"`
+	}{}
+	if !f.decode(w, r, &req) {
+		return
+	}
+	f.lock.Lock()
+	ttl := f.leases[req.ID.Int64()]
+	f.lock.Unlock()
+	//与 etcd 一致, 失效的租约返回的 TTL 为空
+	result := map[string]string{"ID": string(req.ID)}
+	if ttl > 0 {
+		result["TTL"] = strconv.FormatInt(ttl, 10)
+	}
+	reply(w, map[string]interface{}{"result": result})
+}
+
+func (f *fakeEtcd) revoke(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		ID int64String `json:"ID"`
+	}{}
+	if !f.decode(w, r, &req) {
+		return
+	}
+	f.lock.Lock()
+	f.dropLease(req.ID.Int64())
+	f.lock.Unlock()
+	reply(w, map[string]interface{}{})
+}
+
+func (f *fakeEtcd) put(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Key   string      `json:"key"`
+		Value string      `json:"value"`
+		Lease int64String `json:"lease"`
+	}{}
+	if !f.decode(w, r, &req) {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	lease := req.Lease.Int64()
+	if _, ok := f.leases[lease]; lease != 0 && !ok {
+		http.Error(w, `{"error":"etcdserver: requested lease not found"}`, http.StatusBadRequest)
+		return
+	}
+	f.kvs[unb64(req.Key)] = fakeValue{value: unb64(req.Value), lease: lease}
+	reply(w, map[string]interface{}{})
+}
+
+func (f *fakeEtcd) rangeKeys(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Key      string `json:"key"`
+		RangeEnd string `json:"range_end"`
+	}{}
+	if !f.decode(w, r, &req) {
+		return
+	}
+	key, end := unb64(req.Key), unb64(req.RangeEnd)
+	kvs := []map[string]string{}
+	f.lock.Lock()
+	for k, v := range f.kvs {
+		if k == key || (end != "" && k >= key && k < end) {
+			kvs = append(kvs, map[string]string{
+				"key":   base64.StdEncoding.EncodeToString([]byte(k)),
+				"value": base64.StdEncoding.EncodeToString([]byte(v.value)),
+			})
+		}
+	}
+	f.lock.Unlock()
+	reply(w, map[string]interface{}{"kvs": kvs, "count": strconv.Itoa(len(kvs))})
+}
+
+func TestPutGet(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+	client := etcd.client()
+
+	if err := client.Put("/a/b", "value", 0); err != nil {
+		t.Fatal(err)
+	}
+	kv, err := client.Get("/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv == nil || kv.Key != "/a/b" || string(kv.Value) != "value" {
+		t.Fatalf("unexpected kv %+v", kv)
+	}
+	if kv, err = client.Get("/a/missing"); err != nil || kv != nil {
+		t.Fatalf("missing key: %+v %v", kv, err)
+	}
+}
+
+func TestLease(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+	client := etcd.client()
+
+	lease, err := client.Grant(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Put("/leased", "v", lease); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.KeepAliveOnce(lease); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Revoke(lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := etcd.value("/leased"); ok {
+		t.Fatal("key still exists after revoke")
+	}
+	if err = client.KeepAliveOnce(lease); err != ErrLeaseExpired {
+		t.Fatalf("keepalive of revoked lease: %v", err)
+	}
+}
+
+func TestEndpointFailover(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	client := NewEtcdClient([]string{dead.URL, etcd.URL}, time.Second)
+	if err := client.Put("/k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := etcd.value("/k"); !ok {
+		t.Fatal("put did not reach the live endpoint")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"/mafio/agents/g/": "/mafio/agents/g0",
+		"a\xff":            "b",
+		"\xff\xff":         "\x00",
+	}
+	for prefix, expected := range cases {
+		if end := prefixEnd(prefix); end != expected {
+			t.Errorf("prefixEnd(%q) = %q, expected %q", prefix, end, expected)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package discovery
+
+import (
+	"encoding/json"
+	"path"
+	"sort"
+	"time"
+)
+
+//默认注册前缀
+const DefaultPrefix = "/mafio/agents"
+
+//日志接口
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+//agent 注册信息
+type AgentInfo struct {
+	Id          string   `json:"id"`
+	Group       string   `json:"group"`
+	HTTPAddress string   `json:"http_address"`
+	Hostname    string   `json:"hostname"`
+	Version     string   `json:"version"`
+	Input       string   `json:"input"`
+	Filter      string   `json:"filter"`
+	Outputs     []string `json:"outputs"`
+	StartTime   int64    `json:"start_time"`
+}
+
+//注册 key: <prefix>/<group>/<id>
+func AgentKey(prefix, group, id string) string {
+	return path.Join(prefix, group, id)
+}
+
+//服务注册器
+//以租约的方式注册自身, 定期续约; 租约失效后重新注册
+type Registrar struct {
+	client *EtcdClient
+	prefix string
+	ttl    int64
+	info   *AgentInfo
+	logger Logger
+
+	leaseID int64
+}
+
+func NewRegistrar(client *EtcdClient, prefix string, ttl int64, info *AgentInfo, logger Logger) *Registrar {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if ttl < 3 {
+		ttl = 3
+	}
+	return &Registrar{
+		client: client,
+		prefix: prefix,
+		ttl:    ttl,
+		info:   info,
+		logger: logger,
+	}
+}
+
+func (r *Registrar) Key() string {
+	return AgentKey(r.prefix, r.info.Group, r.info.Id)
+}
+
+//申请租约并写入注册信息
+func (r *Registrar) register() error {
+	value, err := json.Marshal(r.info)
+	if err != nil {
+		return err
+	}
+	leaseID, err := r.client.Grant(r.ttl)
+	if err != nil {
+		return err
+	}
+	if err = r.client.Put(r.Key(), string(value), leaseID); err != nil {
+		return err
+	}
+	r.leaseID = leaseID
+	r.logger.Infof("[DISCOVERY]registered %s (lease %x, ttl %ds)", r.Key(), leaseID, r.ttl)
+	return nil
+}
+
+//注册并保持心跳, 直到 exitChan 关闭, 退出时撤销租约
+func (r *Registrar) Run(exitChan chan int) {
+	interval := time.Duration(r.ttl) * time.Second / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if err := r.register(); err != nil {
+		r.logger.Errorf("[DISCOVERY]register %s failed - %s", r.Key(), err)
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if r.leaseID != 0 {
+				err := r.client.KeepAliveOnce(r.leaseID)
+				if err == nil {
+					continue
+				}
+				r.logger.Warnf("[DISCOVERY]keepalive %s failed - %s", r.Key(), err)
+				r.leaseID = 0
+			}
+			if err := r.register(); err != nil {
+				r.logger.Errorf("[DISCOVERY]register %s failed - %s", r.Key(), err)
+			}
+		case <-exitChan:
+			goto exit
+		}
+	}
+exit:
+	if r.leaseID != 0 {
+		if err := r.client.Revoke(r.leaseID); err != nil {
+			r.logger.Warnf("[DISCOVERY]revoke lease of %s failed - %s", r.Key(), err)
+		}
+	}
+	r.logger.Infof("[DISCOVERY]unregistered %s", r.Key())
+}
+
+//列出指定组内存活的 agent
+//只有仍持有有效租约的 agent 才会出现在结果中
+func ListAgents(client *EtcdClient, prefix, group string) ([]*AgentInfo, error) {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	kvs, err := client.GetPrefix(AgentKey(prefix, group, "") + "/")
+	if err != nil {
+		return nil, err
+	}
+	agents := make([]*AgentInfo, 0, len(kvs))
+	for _, kv := range kvs {
+		info := &AgentInfo{}
+		if err := json.Unmarshal(kv.Value, info); err != nil {
+			continue
+		}
+		agents = append(agents, info)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Id < agents[j].Id })
+	return agents, nil
+}
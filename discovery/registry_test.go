@@ -0,0 +1,120 @@
+package discovery
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Infof(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Warnf(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Errorf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+
+//等待条件成立, 超时后失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRegistrarRun(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+
+	info := &AgentInfo{Id: "sky01", Group: "net01", HTTPAddress: "127.0.0.1:10630", Input: "file", Outputs: []string{"stdout"}}
+	registrar := NewRegistrar(etcd.client(), "", 3, info, testLogger{t})
+	key := "/mafio/agents/net01/sky01"
+	if registrar.Key() != key {
+		t.Fatalf("unexpected key %s", registrar.Key())
+	}
+
+	exitChan := make(chan int)
+	done := make(chan struct{})
+	go func() {
+		registrar.Run(exitChan)
+		close(done)
+	}()
+
+	//注册
+	waitFor(t, "register", func() bool {
+		_, ok := etcd.value(key)
+		return ok
+	})
+	v, _ := etcd.value(key)
+	registered := &AgentInfo{}
+	if err := json.Unmarshal([]byte(v.value), registered); err != nil {
+		t.Fatal(err)
+	}
+	if registered.Id != "sky01" || registered.HTTPAddress != "127.0.0.1:10630" || v.lease == 0 {
+		t.Fatalf("unexpected registration %s (lease %d)", v.value, v.lease)
+	}
+
+	//ttl 为 3 秒时每秒续约一次
+	waitFor(t, "keepalive", func() bool { return etcd.count("/v3/lease/keepalive") >= 1 })
+	if etcd.count("/v3/lease/grant") != 1 {
+		t.Fatalf("lease granted %d times while alive", etcd.count("/v3/lease/grant"))
+	}
+
+	//租约失效后重新注册
+	etcd.expire(v.lease)
+	waitFor(t, "re-register", func() bool {
+		nv, ok := etcd.value(key)
+		return ok && nv.lease != v.lease
+	})
+	if etcd.count("/v3/lease/grant") != 2 {
+		t.Fatalf("lease granted %d times after expiry", etcd.count("/v3/lease/grant"))
+	}
+
+	//退出时撤销租约
+	close(exitChan)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registrar did not exit")
+	}
+	if etcd.count("/v3/lease/revoke") != 1 {
+		t.Fatal("lease not revoked on exit")
+	}
+	if _, ok := etcd.value(key); ok {
+		t.Fatal("registration still exists after exit")
+	}
+}
+
+func TestListAgents(t *testing.T) {
+	etcd := newFakeEtcd()
+	defer etcd.Close()
+	client := etcd.client()
+
+	for _, info := range []*AgentInfo{
+		{Id: "b", Group: "web", HTTPAddress: "10.0.0.2:10630"},
+		{Id: "a", Group: "web", HTTPAddress: "10.0.0.1:10630"},
+		{Id: "c", Group: "db", HTTPAddress: "10.0.0.3:10630"},
+	} {
+		value, _ := json.Marshal(info)
+		if err := client.Put(AgentKey(DefaultPrefix, info.Group, info.Id), string(value), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//同一前缀的其他组与无法解析的值不出现在结果中
+	client.Put(AgentKey(DefaultPrefix, "webapp", "x"), `{"id":"x","group":"webapp"}`, 0)
+	client.Put(AgentKey(DefaultPrefix, "web", "broken"), "not json", 0)
+
+	agents, err := ListAgents(client, "", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 {
+		t.Fatalf("expected 2 agents, got %d", len(agents))
+	}
+	if agents[0].Id != "a" || agents[0].HTTPAddress != "10.0.0.1:10630" || agents[1].Id != "b" {
+		t.Fatalf("unexpected agents %+v %+v", agents[0], agents[1])
+	}
+}
@@ -1,17 +1,32 @@
 package cron
 
 import (
+	"errors"
+	"fmt"
 	a "github.com/domac/mafio/agent"
+	p "github.com/domac/mafio/packet"
 	"github.com/domac/mafio/util"
 	"github.com/robfig/cron"
 	"os"
+	"reflect"
+	"sync"
+	"time"
 )
 
 const ModuleName = "cron"
 
-//文件输入服务
+//定时任务输入
+//cron_map 为 cron 表达式到命令列表的映射, mode:
+//
+//	push  默认, 按计划把命令字符串作为事件发送, 由 command 输出执行
+//	exec  按计划执行命令, 执行结果作为事件, 见 exec.go
+//
+//timezone 为 cron 表达式的时区(例如 Asia/Shanghai), 默认为本机时区
 type CronInputService struct {
-	ctx *a.Context
+	ctx     *a.Context
+	cronTab *cron.Cron
+	lock    sync.Mutex
+	running runningJobs //exec 模式正在执行的命令, 重新加载配置时保留
 }
 
 func New() *CronInputService {
@@ -22,46 +37,157 @@ func (self *CronInputService) SetContext(ctx *a.Context) {
 	self.ctx = ctx
 }
 
+//支持通过 Reflesh 重新加载配置
+func (self *CronInputService) SupportsReload() bool {
+	return true
+}
+
+//配置更新后重建作业
 func (self *CronInputService) Reflesh() {
+	cronTab, err := self.newCronTab()
+	if err != nil {
+		self.ctx.Logger().Errorf("cron input reload failed - %s", err)
+		return
+	}
 
-}
+	self.lock.Lock()
+	old := self.cronTab
+	self.cronTab = cronTab
+	self.lock.Unlock()
 
-//开启文件监听
-func (self *CronInputService) StartInput() {
-	self.ctx.Logger().Infof("start cron input service")
-	cronTab := cron.New()
+	if old != nil {
+		old.Stop()
+	}
 	cronTab.Start()
+	self.ctx.Logger().Infoln("cron input reloaded")
+}
+
+//可通过命令行覆盖的配置项
+func (self *CronInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"cron_map":         reflect.Map,
+		"mode":             reflect.String,
+		"timezone":         reflect.String,
+		"timeout":          reflect.Float64,
+		"skip_overlap":     reflect.Bool,
+		"jitter":           reflect.Float64,
+		"max_output_bytes": reflect.Float64,
+	}
+}
 
-	configMap, ok := self.ctx.Agentd.GetOptions().PluginsConfigs[ModuleName]
+//根据配置创建作业表
+func (self *CronInputService) newCronTab() (*cron.Cron, error) {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
 	if !ok {
-		self.ctx.Logger().Error("cron input config not found")
-		os.Exit(2)
+		return nil, errors.New("cron input config not found")
 	}
 
 	cron_map, ok := configMap["cron_map"]
 	if !ok {
-		self.ctx.Logger().Error("cron input config-cron_map not found")
-		os.Exit(2)
+		return nil, errors.New("cron input config-cron_map not found")
+	}
+
+	mode := ModePush
+	if v, ok := configMap["mode"].(string); ok && v != "" {
+		mode = v
+	}
+	if err := checkMode(mode); err != nil {
+		return nil, err
+	}
+	config, err := loadExecConfig(configMap)
+	if err != nil {
+		return nil, err
 	}
 
+	cronTab := cron.NewWithLocation(config.location)
+
 	//cron 作业信息
-	cron_map_dict := cron_map.(map[string]interface{})
+	cron_map_dict, ok := cron_map.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("cron input config-cron_map must be a map")
+	}
 	for express, v := range cron_map_dict {
 		jobs, _ := util.Interface2Stringslice(v)
-		self.ctx.Logger().Infof("load job : %s", express)
-		func(jobList []string) {
-			cronTab.AddFunc(express, func() {
+		self.ctx.Logger().Infof("load job : %s, mode: %s", express, mode)
+		if mode == ModeExec {
+			for _, command := range jobs {
+				job := &execJob{ctx: self.ctx, config: config, schedule: express, command: command, running: &self.running}
+				if err := cronTab.AddJob(express, job); err != nil {
+					return nil, fmt.Errorf("cron express %q - %s", express, err)
+				}
+			}
+			continue
+		}
+		err := func(jobList []string) error {
+			return cronTab.AddFunc(express, func() {
 				for _, j := range jobList {
-					self.ctx.Agentd.Inchan <- []byte(j)
+					select {
+					case self.ctx.Agentd.Inchan <- p.NewPacket([]byte(j)):
+					case <-self.ctx.Agentd.GetExitCh():
+						return
+					}
 				}
 			})
 		}(jobs)
+		if err != nil {
+			return nil, fmt.Errorf("cron express %q - %s", express, err)
+		}
+	}
+	return cronTab, nil
+}
+
+//读取执行模式与时区的配置
+func loadExecConfig(configMap map[string]interface{}) (*execConfig, error) {
+	config := &execConfig{
+		timeout:        defaultTimeout,
+		skipOverlap:    true,
+		maxOutputBytes: defaultMaxOutputBytes,
+		location:       time.Local,
+	}
+	if v, ok := configMap["timezone"].(string); ok && v != "" {
+		location, err := time.LoadLocation(v)
+		if err != nil {
+			return nil, fmt.Errorf("cron input timezone %q - %s", v, err)
+		}
+		config.location = location
+	}
+	if v, ok := configMap["timeout"].(float64); ok && v >= 0 {
+		config.timeout = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := configMap["skip_overlap"].(bool); ok {
+		config.skipOverlap = v
+	}
+	if v, ok := configMap["jitter"].(float64); ok && v > 0 {
+		config.jitter = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := configMap["max_output_bytes"].(float64); ok && v >= 0 {
+		config.maxOutputBytes = int(v)
 	}
+	return config, nil
+}
+
+//开启文件监听
+func (self *CronInputService) StartInput() {
+	self.ctx.Logger().Infof("start cron input service")
+
+	cronTab, err := self.newCronTab()
+	if err != nil {
+		self.ctx.Logger().Error(err)
+		os.Exit(2)
+	}
+
+	self.lock.Lock()
+	self.cronTab = cronTab
+	self.lock.Unlock()
+	cronTab.Start()
 
 	select {
 	case <-self.ctx.Agentd.GetExitCh():
 		goto EXIT
 	}
 EXIT:
+	self.lock.Lock()
+	self.cronTab.Stop()
+	self.lock.Unlock()
 	self.ctx.Logger().Infoln("cron input exit")
 }
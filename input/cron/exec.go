@@ -0,0 +1,227 @@
+package cron
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	a "github.com/domac/mafio/agent"
+	p "github.com/domac/mafio/packet"
+	"math/rand"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//执行模式
+//mode 为 exec 时按计划执行 cron_map 中的命令(sh -c), 每次执行的结果作为一个事件:
+//
+//	command      命令
+//	schedule     cron 表达式
+//	started_at   开始时间(timezone 时区)
+//	duration_ms  执行时间
+//	exit_code    退出码, 无法启动或者超时被终止时为 -1
+//	stdout       标准输出, 超过 max_output_bytes 的部分丢弃并带有 output_truncated 标签
+//	stderr       标准错误输出
+//	error        无法启动、超时等错误
+//
+//退出码不为 0 的事件带有 cron_failed 标签, 超时的事件还带有 cron_timeout 标签
+//
+//timeout       单次执行的超时时间(秒, 默认 60, 0 为不限制), 超时后终止命令及其启动的所有子进程
+//skip_overlap  上一次执行还没有结束时跳过本次执行(默认 true), 重新加载配置后同一计划的同一命令仍然不会重叠
+//jitter        每次执行前随机等待 0 ~ jitter 秒, 避免大量 agent 同时执行
+
+const (
+	ModePush = "push"
+	ModeExec = "exec"
+
+	FieldCommand    = "command"
+	FieldSchedule   = "schedule"
+	FieldStartedAt  = "started_at"
+	FieldDurationMs = "duration_ms"
+	FieldExitCode   = "exit_code"
+	FieldStdout     = "stdout"
+	FieldStderr     = "stderr"
+	FieldError      = "error"
+
+	TagFailed          = "cron_failed"
+	TagTimeout         = "cron_timeout"
+	TagOutputTruncated = "output_truncated"
+
+	defaultTimeout        = 60 * time.Second
+	defaultMaxOutputBytes = 64 * 1024
+
+	//超时终止进程组后, 等待输出关闭的时间
+	waitDelay = time.Second
+)
+
+func checkMode(mode string) error {
+	switch mode {
+	case ModePush, ModeExec:
+		return nil
+	}
+	return errors.New("cron input mode must be push or exec, got " + mode)
+}
+
+//执行模式的配置, 重新加载配置时与作业表一起替换
+type execConfig struct {
+	timeout        time.Duration
+	skipOverlap    bool
+	jitter         time.Duration
+	maxOutputBytes int
+	location       *time.Location
+}
+
+//正在执行的命令, 按 cron 表达式与命令区分
+//重新加载配置时作业会重建, 执行状态由输入插件保存, 重建之前开始的执行同样可以阻止重叠
+type runningJobs struct {
+	lock sync.Mutex
+	jobs map[string]bool
+}
+
+//标记开始执行, 已经在执行时返回 false
+func (self *runningJobs) start(key string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.jobs[key] {
+		return false
+	}
+	if self.jobs == nil {
+		self.jobs = make(map[string]bool)
+	}
+	self.jobs[key] = true
+	return true
+}
+
+func (self *runningJobs) done(key string) {
+	self.lock.Lock()
+	delete(self.jobs, key)
+	self.lock.Unlock()
+}
+
+//一个计划中的一条命令
+type execJob struct {
+	ctx      *a.Context
+	config   *execConfig
+	schedule string
+	command  string
+	running  *runningJobs
+}
+
+func (self *execJob) Run() {
+	if self.config.skipOverlap {
+		key := self.schedule + "\x00" + self.command
+		if !self.running.start(key) {
+			self.ctx.Logger().Warnf("cron job %q is still running, skip this run", self.command)
+			return
+		}
+		defer self.running.done(key)
+	}
+
+	exitCh := self.ctx.Agentd.GetExitCh()
+	if jitter := self.config.jitter; jitter > 0 {
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(jitter)))):
+		case <-exitCh:
+			return
+		}
+	}
+
+	pkt := self.execute()
+	select {
+	case self.ctx.Agentd.Inchan <- pkt:
+	case <-exitCh:
+	}
+}
+
+//执行命令, 返回结果事件
+func (self *execJob) execute() *p.Packet {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if self.config.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), self.config.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	//agent 退出时终止命令
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-self.ctx.Agentd.GetExitCh():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	stdout := &limitedBuffer{max: self.config.maxOutputBytes}
+	stderr := &limitedBuffer{max: self.config.maxOutputBytes}
+	cmd := exec.CommandContext(ctx, "sh", "-c", self.command)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	//命令在单独的进程组中执行, 超时或者退出时终止整个进程组, 后台的子进程不会残留
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+
+	self.ctx.Logger().Debugf("cron job %q start", self.command)
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+
+	pkt := p.NewPacket([]byte(self.command))
+	pkt.SetField(FieldCommand, self.command)
+	pkt.SetField(FieldSchedule, self.schedule)
+	pkt.SetField(FieldStartedAt, start.In(self.config.location).Format(time.RFC3339Nano))
+	pkt.SetField(FieldDurationMs, float64(duration)/float64(time.Millisecond))
+	pkt.SetField(FieldStdout, stdout.String())
+	pkt.SetField(FieldStderr, stderr.String())
+	if stdout.dropped > 0 || stderr.dropped > 0 {
+		pkt.AddTag(TagOutputTruncated)
+	}
+
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+			exitCode = exitErr.ExitCode()
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.New("timeout after " + self.config.timeout.String())
+			pkt.AddTag(TagTimeout)
+		}
+		pkt.SetField(FieldError, err.Error())
+		pkt.AddTag(TagFailed)
+	}
+	//与 json 解码后的数字类型一致
+	pkt.SetField(FieldExitCode, float64(exitCode))
+	self.ctx.Logger().Debugf("cron job %q end, exit code %d, %s", self.command, exitCode, duration)
+	return pkt
+}
+
+//只保留前 max 个字节的输出
+type limitedBuffer struct {
+	buffer  bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (self *limitedBuffer) Write(b []byte) (int, error) {
+	room := len(b)
+	if self.max > 0 && self.buffer.Len()+room > self.max {
+		room = self.max - self.buffer.Len()
+	}
+	self.buffer.Write(b[:room])
+	self.dropped += len(b) - room
+	return len(b), nil
+}
+
+func (self *limitedBuffer) String() string {
+	return self.buffer.String()
+}
@@ -0,0 +1,86 @@
+package input
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+//批量模式 (mode: batch)
+//用于补传历史文件: 匹配的文件从 sincedb 记录的位置(没有记录时从头)读到末尾, 不等待新内容,
+//所有文件读完并且输出全部发送成功后保存 sincedb, 输出读取的文件数、行数与字节数, 然后退出;
+//有输出发送失败时不保存 sincedb, 以非0状态码退出, 再次运行时重新读取这些内容
+//
+//已经读完的文件再次运行时只读取新增的部分, 读取完成的压缩文件不再读取
+
+const (
+	ModeTail  = "tail"
+	ModeBatch = "batch"
+)
+
+func checkMode(mode string) error {
+	switch mode {
+	case ModeTail, ModeBatch:
+		return nil
+	}
+	return errors.New("file input mode must be tail or batch, got " + mode)
+}
+
+//依次读取匹配的文件, 完成后退出
+func (self *FileInputService) batchRun() {
+	var (
+		files, bytes int64
+		start        = time.Now()
+		failures     = self.ctx.Agentd.WriteFailures()
+	)
+
+	matches, _ := self.matchedFiles()
+	self.ctx.Logger().Infof("[FILE]batch mode, %d files matched", len(matches))
+
+	for _, f := range matches {
+		self.touchSinceDBInfo(f.key, f.path)
+		before := self.sinceDBOffset(f.key)
+
+		r := &fileReader{
+			key:     f.key,
+			path:    f.path,
+			pattern: f.pattern,
+			stop:    make(chan struct{}),
+		}
+		if _, err := self.fileReadLoop(r, "beginning"); err != nil {
+			self.ctx.Logger().Errorf("read file %q failed - %s", f.path, err)
+			continue
+		}
+
+		//截断或者被新文件复用的文件从头读取
+		after := self.sinceDBOffset(f.key)
+		if after < before {
+			before = 0
+		}
+		files++
+		bytes += after - before
+		self.ctx.Logger().Debugf("[FILE]batch read %q, %d bytes", f.path, after-before)
+	}
+
+	lines := atomic.LoadInt64(&self.linesRead)
+	self.ctx.Logger().Infof("[FILE]batch read %d files, %d lines, %d bytes in %s, wait for outputs to flush",
+		files, lines, bytes, time.Since(start))
+
+	//输出发送完成后再保存读取位置
+	if !self.ctx.Agentd.WaitFlushed() {
+		return
+	}
+	if n := self.ctx.Agentd.WriteFailures() - failures; n > 0 {
+		self.ctx.Logger().Errorf("[FILE]batch failed, %d output writes failed, read positions are not saved", n)
+		self.ctx.Agentd.Exit()
+		os.Exit(1)
+	}
+	self.SaveSinceDBInfos()
+	self.ctx.Logger().Infof("[FILE]batch shipped %d files, %d lines, %d bytes in %s",
+		files, lines, bytes, time.Since(start))
+	if skipped := atomic.LoadInt64(&self.binarySkipped); skipped > 0 {
+		self.ctx.Logger().Infof("[FILE]batch skipped %d binary lines", skipped)
+	}
+	self.ctx.Agentd.ExitAfterFlush()
+}
@@ -0,0 +1,97 @@
+package input
+
+import (
+	"bufio"
+	"errors"
+	"github.com/domac/mafio/codec"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+//压缩的归档文件
+//路径模式匹配到 gzip 或 zstd 压缩的文件(例如轮转后的 app.log.3.gz)时按 magic 识别并解压读取,
+//sincedb 中的位置为解压后的位置, 中途退出后从该位置继续; 读到末尾后标记为完成, 之后不再读取
+
+//按文件开头的 magic 判断压缩格式, 不是压缩文件时返回空
+func detectCompression(fp *os.File) (string, error) {
+	magic := make([]byte, 4)
+	n, err := fp.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", errors.New("read file header failed: " + fp.Name())
+	}
+	return codec.DetectCompression(magic[:n]), nil
+}
+
+//解压读取到末尾, 完成后返回 inactive, 文件保持关闭
+//压缩文件还在写入时解压会出错, 交给之后的扫描从记录的位置重新读取
+func (self *FileInputService) readCompressed(fp *os.File, since *SinceDBInfo, format string, src *eventSource) (inactive bool, err error) {
+	var (
+		rd     io.ReadCloser
+		line   string
+		size   int
+		cut    bool
+		offset = since.Offset
+	)
+
+	if since.Completed {
+		return true, nil
+	}
+
+	if rd, err = codec.NewDecompressReader(fp, format); err != nil {
+		err = errors.New(format + " open failed: " + fp.Name())
+		return
+	}
+	defer rd.Close()
+
+	//UTF-16 按解压后数据开头的 BOM 确定字节序
+	var input io.Reader = rd
+	charset := self.charset
+	if charset != nil && charset.IsUTF16() {
+		buffered := bufio.NewReader(rd)
+		head, _ := buffered.Peek(2)
+		charset = charset.WithBOM(head)
+		input = buffered
+	}
+
+	if offset > 0 {
+		self.ctx.Logger().Infof("Resume %s file at %d: %q", format, offset, fp.Name())
+		if _, err = io.CopyN(ioutil.Discard, input, offset); err != nil {
+			err = errors.New(format + " seek failed: " + fp.Name())
+			return
+		}
+	} else {
+		self.ctx.Logger().Infof("Read %s file: %q", format, fp.Name())
+	}
+
+	reader := newLineReader(input, charset, self.MaxBytes)
+	for {
+		if line, size, cut, err = reader.readline(); err != nil {
+			if err != io.EOF {
+				return
+			}
+			break
+		}
+		//agent 退出时停止, 之后从记录的位置继续
+		if !self.pushLine(src, line, cut, offset) {
+			return false, nil
+		}
+		offset += int64(size)
+		self.setSinceDBOffset(since, offset)
+		self.CheckSaveSinceDBInfos()
+	}
+
+	//最后一行可能没有换行符
+	offset = self.pushTail(src, reader, since, offset)
+	self.flushAssembler(src)
+	if self.exiting() {
+		return false, nil
+	}
+	//立即保存完成状态, 重启后不会重复读取
+	self.completeSinceDBInfo(since)
+	if self.Mode != ModeBatch {
+		self.SaveSinceDBInfos()
+	}
+	self.ctx.Logger().Infof("Finished %s file: %q, %d bytes", format, fp.Name(), offset)
+	return true, nil
+}
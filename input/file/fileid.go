@@ -0,0 +1,14 @@
+package input
+
+import (
+	"os"
+	"syscall"
+)
+
+//文件标识: 设备号与 inode
+func fileIdentity(fi os.FileInfo) (device, inode uint64) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
@@ -1,15 +1,15 @@
 package input
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	a "github.com/domac/mafio/agent"
-	"github.com/go-fsnotify/fsnotify"
+	"github.com/domac/mafio/codec"
+	"github.com/domac/mafio/util"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
+	"reflect"
+	"regexp"
+	"sync"
 	"time"
 )
 
@@ -20,13 +20,48 @@ type FileInputService struct {
 	ctx *a.Context
 
 	Path                 string                  `json:"path"`
+	Paths                []*PathPattern          `json:"paths,omitempty"`         //所有路径模式, 包括 Path
+	Fields               map[string]interface{}  `json:"fields,omitempty"`        //添加到每个事件的静态字段
+	Tags                 []string                `json:"tags,omitempty"`          //添加到每个事件的标签
+	ExcludeFiles         []string                `json:"exclude_files,omitempty"` //不读取匹配这些正则的路径
+	excludes             []*regexp.Regexp        `json:"-"`
+	skippedDirs          map[string]bool         `json:"-"`               //已经提示过的目录
+	Codec                string                  `json:"codec,omitempty"` // one of ["line", "json", "json_lines", "multiline"]
+	Multiline            map[string]interface{}  `json:"multiline,omitempty"`
+	Charset              string                  `json:"charset,omitempty"` // e.g. "gbk", "gb18030", "big5", "latin1", "utf-16le"
+	CharsetReplacement   string                  `json:"charset_replacement,omitempty"`
+	charset              *codec.Charset          `json:"-"`
 	StartPos             string                  `json:"start_position,omitempty"` // one of ["beginning", "end"]
+	Mode                 string                  `json:"mode,omitempty"`           // one of ["tail", "batch"]
+	MaxBytes             int                     `json:"max_bytes,omitempty"`      //单行最大的字节数
+	Binary               string                  `json:"binary,omitempty"`         // one of ["keep", "skip", "hex"]
+	PartialLineTimeout   time.Duration           `json:"partial_line_timeout,omitempty"`
+	binarySkipped        int64                   `json:"-"`
+	linesRead            int64                   `json:"-"`
 	SinceDBPath          string                  `json:"sincedb_path,omitempty"`
 	SinceDBWriteInterval int                     `json:"sincedb_write_interval,omitempty"`
+	SinceDBCleanAfter    int                     `json:"sincedb_clean_after,omitempty"` //清理超过这个时间(秒)没有出现过的文件的记录, 0 为不清理
+	ScanInterval         int                     `json:"scan_interval,omitempty"`       //重新扫描路径模式的间隔(秒)
+	WatchMode            string                  `json:"watch_mode,omitempty"`          // one of ["auto", "fsnotify", "poll"]
+	PollInterval         time.Duration           `json:"poll_interval,omitempty"`       //轮询文件的间隔
+	polling              int32                   `json:"-"`
+	rescan               chan struct{}           `json:"-"` //请求立即重新扫描
 	hostname             string                  `json:"-"`
+	agentId              string                  `json:"-"`
+	agentGroup           string                  `json:"-"`
 	SinceDBInfos         map[string]*SinceDBInfo `json:"-"`
 	sinceDBLastInfosRaw  []byte                  `json:"-"`
 	SinceDBLastSaveTime  time.Time               `json:"-"`
+	sinceDBLock          sync.Mutex              `json:"-"` //保护 SinceDBInfos 及其中的记录
+	sinceDBSaveLock      sync.Mutex              `json:"-"`
+	FingerprintBytes     int                     `json:"fingerprint_bytes,omitempty"` //按文件开头的字节识别 inode 被复用的文件, 0 为不校验
+	CloseInactive        int                     `json:"close_inactive,omitempty"`    //超过这个时间(秒)没有新内容的文件关闭, 0 为不关闭
+	MaxOpenFiles         int                     `json:"max_open_files,omitempty"`    //同时打开的文件数上限, 0 为不限制
+	IgnoreOlder          int                     `json:"ignore_older,omitempty"`      //不打开超过这个时间(秒)没有修改的文件, 0 为不忽略
+	readers              map[string]*fileReader  `json:"-"`                           //匹配的文件, 按文件标识索引
+	readerPaths          map[string]*fileReader  `json:"-"`                           //匹配的文件, 按路径索引, 用于分发目录事件
+	openFiles            int                     `json:"-"`
+	readersLock          sync.Mutex              `json:"-"`
 }
 
 func New() *FileInputService {
@@ -36,185 +71,379 @@ func New() *FileInputService {
 func (self *FileInputService) SetContext(ctx *a.Context) {
 	self.ctx = ctx
 	self.StartPos = "end"
+	self.Mode = ModeTail
+	self.MaxBytes = defaultMaxBytes
+	self.Binary = BinaryKeep
 	self.SinceDBPath = "/tmp/sincedb.json"
 	self.SinceDBWriteInterval = 15
+	self.SinceDBCleanAfter = defaultSinceDBCleanAfter
+	self.ScanInterval = defaultScanInterval
+	self.WatchMode = WatchAuto
+	self.PollInterval = defaultPollInterval
+	self.rescan = make(chan struct{}, 1)
 	self.SinceDBInfos = map[string]*SinceDBInfo{}
+	self.CloseInactive = defaultCloseInactive
+	self.readers = map[string]*fileReader{}
+	self.readerPaths = map[string]*fileReader{}
+	self.skippedDirs = map[string]bool{}
 }
 
 func (self *FileInputService) Reflesh() {
 
 }
 
+//可通过命令行覆盖的配置项
+func (self *FileInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"stdFilePath":          reflect.String,
+		"paths":                reflect.Slice,
+		"exclude_files":        reflect.Slice,
+		"fields":               reflect.Map,
+		"tags":                 reflect.Slice,
+		"codec":                reflect.String,
+		"mode":                 reflect.String,
+		"max_bytes":            reflect.Float64,
+		"binary":               reflect.String,
+		"partial_line_timeout": reflect.Float64,
+		"multiline":            reflect.Map,
+		"charset":              reflect.String,
+		"scan_interval":        reflect.Float64,
+		"watch_mode":           reflect.String,
+		"poll_interval":        reflect.Float64,
+		"fingerprint_bytes":    reflect.Float64,
+		"sincedb_clean_after":  reflect.Float64,
+		"close_inactive":       reflect.Float64,
+		"max_open_files":       reflect.Float64,
+		"ignore_older":         reflect.Float64,
+	}
+}
+
 //开启文件监听
 func (self *FileInputService) StartInput() {
 
-	configMap, ok := self.ctx.Agentd.GetOptions().PluginsConfigs[ModuleName]
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
 	if !ok {
 		self.ctx.Logger().Errorln("could't load file-input config file")
 		os.Exit(2)
 	}
 
-	self.Path = configMap["stdFilePath"].(string)
+	//stdFilePath 与 paths 都可以配置路径模式, 支持 ** 匹配多级目录
+	self.Path, _ = configMap["stdFilePath"].(string)
+	self.Paths = nil
+	if self.Path != "" {
+		self.Paths = append(self.Paths, &PathPattern{Path: self.Path})
+	}
+	if items, ok := configMap["paths"].([]interface{}); ok {
+		for _, item := range items {
+			pattern := parsePathPattern(item)
+			if pattern == nil {
+				self.ctx.Logger().Errorf("file input fail: invalid paths item %v", item)
+				os.Exit(2)
+			}
+			self.Paths = append(self.Paths, pattern)
+		}
+	}
+
+	for _, pattern := range self.Paths {
+		self.ctx.Logger().Infof("plugins input filepath %s", pattern.Path)
+	}
 
-	self.ctx.Logger().Infof("plugins input filepath %s", self.Path)
+	self.ExcludeFiles, _ = util.Interface2Stringslice(configMap["exclude_files"])
+	self.excludes = nil
+	for _, expr := range self.ExcludeFiles {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			self.ctx.Logger().Errorf("file input fail: invalid exclude_files %q - %s", expr, err)
+			os.Exit(2)
+		}
+		self.excludes = append(self.excludes, re)
+	}
 
-	if self.Path == "" {
+	//文件按行读取, 只支持按行解码的编解码
+	self.Codec, _ = configMap["codec"].(string)
+	if _, err := codec.DecodeLine(self.Codec, nil); err != nil {
+		self.ctx.Logger().Errorf("file input fail: %s", err)
+		os.Exit(2)
+	}
+	//字符集转换, 按行转换为 UTF-8
+	self.Charset, _ = configMap["charset"].(string)
+	self.CharsetReplacement, _ = configMap["charset_replacement"].(string)
+	if self.Charset != "" {
+		charset, err := codec.NewCharset(self.Charset, self.CharsetReplacement)
+		if err != nil {
+			self.ctx.Logger().Errorf("file input fail: %s", err)
+			os.Exit(2)
+		}
+		self.charset = charset
+	}
+	//多行合并, 每个文件各自合并, 这里只校验配置
+	if self.Codec == codec.Multiline {
+		self.Multiline, _ = configMap["multiline"].(map[string]interface{})
+		if _, err := codec.NewMultilineAssembler(self.Multiline); err != nil {
+			self.ctx.Logger().Errorf("file input fail: %s", err)
+			os.Exit(2)
+		}
+	}
+
+	//事件的来源信息
+	self.Fields, _ = configMap["fields"].(map[string]interface{})
+	self.Tags, _ = util.Interface2Stringslice(configMap["tags"])
+	self.hostname, _ = os.Hostname()
+	self.agentId = self.ctx.Agentd.GetOptions().AgentId
+	self.agentGroup = self.ctx.Agentd.GetOptions().AgentGroup
+
+	if len(self.Paths) == 0 {
 		self.ctx.Logger().Errorln("file input fail: no file path found")
 		os.Exit(2)
 		return
 	}
 
-	var (
-		matches []string
-		fi      os.FileInfo
-		err     error
-	)
+	if v, ok := configMap["scan_interval"].(float64); ok && v > 0 {
+		self.ScanInterval = int(v)
+	}
+	if v, ok := configMap["fingerprint_bytes"].(float64); ok && v > 0 {
+		self.FingerprintBytes = int(v)
+	}
+	if v, ok := configMap["sincedb_clean_after"].(float64); ok && v >= 0 {
+		self.SinceDBCleanAfter = int(v)
+	}
+	if v, ok := configMap["close_inactive"].(float64); ok && v >= 0 {
+		self.CloseInactive = int(v)
+	}
+	if v, ok := configMap["max_open_files"].(float64); ok && v >= 0 {
+		self.MaxOpenFiles = int(v)
+	}
+	if v, ok := configMap["ignore_older"].(float64); ok && v >= 0 {
+		self.IgnoreOlder = int(v)
+	}
+
+	if v, ok := configMap["watch_mode"].(string); ok && v != "" {
+		self.WatchMode = v
+	}
+	if err := checkWatchMode(self.WatchMode); err != nil {
+		self.ctx.Logger().Errorf("file input fail: %s", err)
+		os.Exit(2)
+	}
+	if self.WatchMode == WatchPoll {
+		self.polling = 1
+	}
+	if v, ok := configMap["poll_interval"].(float64); ok && v > 0 {
+		self.PollInterval = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := configMap["max_bytes"].(float64); ok && v >= 0 {
+		self.MaxBytes = int(v)
+	}
+	if v, ok := configMap["binary"].(string); ok && v != "" {
+		self.Binary = v
+	}
+	if err := checkBinaryMode(self.Binary); err != nil {
+		self.ctx.Logger().Errorf("file input fail: %s", err)
+		os.Exit(2)
+	}
+	if v, ok := configMap["partial_line_timeout"].(float64); ok && v > 0 {
+		self.PartialLineTimeout = time.Duration(v * float64(time.Second))
+	}
+	if v, ok := configMap["mode"].(string); ok && v != "" {
+		self.Mode = v
+	}
+	if err := checkMode(self.Mode); err != nil {
+		self.ctx.Logger().Errorf("file input fail: %s", err)
+		os.Exit(2)
+	}
 
 	//载入disk数据库
-	if err = self.LoadSinceDBInfos(); err != nil {
+	if err := self.LoadSinceDBInfos(); err != nil {
 		return
 	}
 
-	if matches, err = filepath.Glob(self.Path); err != nil {
-		self.ctx.Logger().Errorf("gob (%s) failed", self.Path)
+	if self.Mode == ModeBatch {
+		go self.batchRun()
 		return
 	}
-
 	go self.CheckSaveSinceDBInfosLoop()
-
-	for _, fpath := range matches {
-		if fpath, err = filepath.EvalSymlinks(fpath); err != nil {
-			self.ctx.Logger().Errorf("Get symlinks failed: %q\n%v", fpath, err)
-			continue
-		}
-
-		if fi, err = os.Stat(fpath); err != nil {
-			self.ctx.Logger().Errorf("stat(%q) failed\n%s", self.Path, err)
-			continue
-		}
-
-		if fi.IsDir() {
-			self.ctx.Logger().Infof("Skipping directory: %q", self.Path)
-			continue
-		}
-
-		readEventChan := make(chan fsnotify.Event, 10)
-		//文件读入
-		go self.fileReadLoop(readEventChan, fpath)
-		//文件事件监听
-		go self.fileWatchLoop(readEventChan, fpath, fsnotify.Create|fsnotify.Write)
-	}
+	go self.scanLoop()
 }
 
+//文件改名或删除后, 写日志的程序可能还会继续写入一段时间,
+//停止读取后文件超过这个时间没有新内容才关闭
+const stopReadingWait = 5 * time.Second
+
 //文件读入
-func (self *FileInputService) fileReadLoop(
-	readEventChan chan fsnotify.Event,
-	fpath string,
-) (err error) {
+//停止后继续读到文件末尾再关闭, 文件改名或删除前后写入的内容不会丢失
+//超过 CloseInactive 秒没有新内容时关闭文件并返回 inactive
+func (self *FileInputService) fileReadLoop(r *fileReader, startPos string) (inactive bool, err error) {
 	var (
 		since     *SinceDBInfo
 		fp        *os.File
+		fi        os.FileInfo
 		truncated bool
-		ok        bool
+		stopping  bool
+		lastRead  time.Time
+		offset    int64
 		whence    int
-		reader    *bufio.Reader
+		reader    *lineReader
 		line      string
 		size      int
+		cut       bool
 
-		buffer = &bytes.Buffer{}
+		src        = &eventSource{r: r}
+		fpath      = self.readerPath(r)
+		flushCheck <-chan time.Time
 	)
 
-	if fpath, err = filepath.EvalSymlinks(fpath); err != nil {
-		self.ctx.Logger().Errorf("Get symlinks failed: %q\n%v", fpath, err)
-		return
+	//多行合并的状态按文件保存, 避免多个文件的行混在一起
+	if self.Codec == codec.Multiline {
+		if src.assembler, err = codec.NewMultilineAssembler(self.Multiline); err != nil {
+			return
+		}
+		ticker := time.NewTicker(src.assembler.CheckInterval())
+		defer ticker.Stop()
+		flushCheck = ticker.C
 	}
 
-	if since, ok = self.SinceDBInfos[fpath]; !ok {
-		self.SinceDBInfos[fpath] = &SinceDBInfo{}
-		since = self.SinceDBInfos[fpath]
+	if fp, err = os.Open(fpath); err != nil {
+		err = errors.New("open file failed: " + fpath)
+		return
 	}
+	defer fp.Close()
 
-	if since.Offset == 0 {
-		if self.StartPos == "end" {
-			whence = os.SEEK_END
-		} else {
-			whence = os.SEEK_SET
-		}
-	} else {
-		whence = os.SEEK_SET
+	//扫描之后路径可能已经指向新的文件, 交给下一次扫描处理
+	if fi, err = fp.Stat(); err != nil {
+		err = errors.New("stat file failed: " + fpath)
+		return
+	}
+	if sinceDBKey(fpath, fi) != r.key {
+		self.ctx.Logger().Debugf("File replaced before open: %q", fpath)
+		return false, nil
 	}
 
-	if fp, reader, err = openfile(fpath, since.Offset, whence); err != nil {
+	since = self.sinceDBInfo(r.key, fpath, fi)
+	_, src.inode = fileIdentity(fi)
+	if err = self.checkFingerprint(fp, since); err != nil {
 		return
 	}
-	defer fp.Close()
 
-	if truncated, err = isFileTruncated(fp, since); err != nil {
+	//压缩的归档文件解压后读取一次, 不需要等待新内容
+	if format, err := detectCompression(fp); err != nil {
+		return false, err
+	} else if format != "" {
+		return self.readCompressed(fp, since, format, src)
+	}
+
+	//记录只由当前协程修改, 读取不需要加锁
+	offset = since.Offset
+	if truncated, err = isFileTruncated(fp, offset); err != nil {
 		return
 	}
 	if truncated {
 		self.ctx.Logger().Warnf("File truncated, seeking to beginning: %q", fpath)
-		since.Offset = 0
-		if _, err = fp.Seek(since.Offset, os.SEEK_SET); err != nil {
-			self.ctx.Logger().Errorf("seek file failed: %q", fpath)
-			return
-		}
+		offset = 0
+	}
+
+	//没有记录的文件按 startPos 开始读取, 并记录实际的位置
+	if offset == 0 && startPos == "end" {
+		whence = os.SEEK_END
+	} else {
+		whence = os.SEEK_SET
+	}
+	if offset, err = fp.Seek(offset, whence); err != nil {
+		err = errors.New("seek file failed: " + fpath)
+		return
 	}
+	self.setSinceDBOffset(since, offset)
+	reader = newLineReader(fp, charsetWithBOM(self.charset, fp), self.MaxBytes)
+	lastRead = time.Now()
 
 	for {
-		if line, size, err = readline(reader, buffer); err != nil {
-			if err == io.EOF {
-				watchev := <-readEventChan
-				//self.ctx.Logger().Debug("fileReadLoop recv:", watchev)
-				if watchev.Op&fsnotify.Create == fsnotify.Create {
-					self.ctx.Logger().Warnf("File recreated, seeking to beginning: %q", fpath)
-					fp.Close()
-					since.Offset = 0
-					if fp, reader, err = openfile(fpath, since.Offset, os.SEEK_SET); err != nil {
-						return
-					}
+		//agent 退出时停止读取, 已经发送的位置之后的内容留给下次启动
+		if self.exiting() {
+			return false, nil
+		}
+		if line, size, cut, err = reader.readline(); err != nil {
+			if err != io.EOF {
+				return
+			}
+			if self.Mode == ModeBatch {
+				//批量模式读到末尾即结束, 没有换行符的最后一行也输出
+				offset = self.pushTail(src, reader, since, offset)
+				self.flushAssembler(src)
+				return false, nil
+			}
+			if stopping {
+				if time.Since(lastRead) < stopReadingWait {
+					time.Sleep(time.Second)
+					continue
 				}
-				if truncated, err = isFileTruncated(fp, since); err != nil {
-					return
+				//已经读到末尾, 输出未合并完的行
+				self.flushAssembler(src)
+				return false, nil
+			}
+			var idle <-chan time.Time
+			if self.CloseInactive > 0 {
+				wait := time.Duration(self.CloseInactive)*time.Second - time.Since(lastRead)
+				if wait <= 0 {
+					self.flushAssembler(src)
+					return true, nil
 				}
-				if truncated {
-					self.ctx.Logger().Warnf("File truncated, seeking to beginning: %q", fpath)
-					since.Offset = 0
-					if _, err = fp.Seek(since.Offset, os.SEEK_SET); err != nil {
-						self.ctx.Logger().Errorf("seek file failed: %q", fpath)
-						return
-					}
+				idle = time.After(wait)
+			}
+			//没有换行符的行等待超时后输出
+			var partial <-chan time.Time
+			if self.PartialLineTimeout > 0 && reader.pending() > 0 {
+				wait := self.PartialLineTimeout - reader.waited()
+				if wait <= 0 {
+					offset = self.pushTail(src, reader, since, offset)
 					continue
 				}
-				//self.ctx.Logger().Debugf("watch %q %q %v", watchev.Name, fpath, watchev)
+				partial = time.After(wait)
+			}
+			select {
+			case <-idle:
 				continue
-			} else {
+			case <-partial:
+				continue
+			case <-r.events:
+			case <-self.pollWait():
+				self.checkReplaced(r)
+			case <-r.stop:
+				//文件已经删除或者改名为不匹配的路径, 读到末尾后停止
+				stopping = true
+				lastRead = time.Now()
+				continue
+			case <-flushCheck:
+				//等待后续行超时
+				self.flushExpired(src)
+				continue
+			case <-self.ctx.Agentd.GetExitCh():
+				return false, nil
+			}
+			if truncated, err = isFileTruncated(fp, offset); err != nil {
 				return
 			}
+			if truncated {
+				self.ctx.Logger().Warnf("File truncated, seeking to beginning: %q", self.readerPath(r))
+				offset = 0
+				self.setSinceDBOffset(since, offset)
+				if _, err = fp.Seek(offset, os.SEEK_SET); err != nil {
+					err = errors.New("seek file failed: " + fpath)
+					return
+				}
+				reader.reset()
+			}
+			continue
 		}
 
-		since.Offset += int64(size)
-
-		self.ctx.Agentd.Inchan <- []byte(line)
-		self.CheckSaveSinceDBInfos()
-	}
-}
-
-//文件操作事件监听
-func (self *FileInputService) fileWatchLoop(readEventChan chan fsnotify.Event, fpath string, op fsnotify.Op) (err error) {
-	var (
-		event fsnotify.Event
-	)
-	for {
-		if event, err = waitWatchEvent(fpath, op); err != nil {
-			return
+		if !reader.tailEnd && !self.pushLine(src, line, cut, offset) {
+			return false, nil
 		}
-		readEventChan <- event
+		offset += int64(size)
+		self.setSinceDBOffset(since, offset)
+		lastRead = time.Now()
+		self.CheckSaveSinceDBInfos()
 	}
-	return
 }
 
-func isFileTruncated(fp *os.File, since *SinceDBInfo) (truncated bool, err error) {
+func isFileTruncated(fp *os.File, offset int64) (truncated bool, err error) {
 	var (
 		fi os.FileInfo
 	)
@@ -222,7 +451,7 @@ func isFileTruncated(fp *os.File, since *SinceDBInfo) (truncated bool, err error
 		err = errors.New("stat file failed: " + fp.Name())
 		return
 	}
-	if fi.Size() < since.Offset {
+	if fi.Size() < offset {
 		truncated = true
 	} else {
 		truncated = false
@@ -230,109 +459,11 @@ func isFileTruncated(fp *os.File, since *SinceDBInfo) (truncated bool, err error
 	return
 }
 
-func openfile(fpath string, offset int64, whence int) (fp *os.File, reader *bufio.Reader, err error) {
-	if fp, err = os.Open(fpath); err != nil {
-		err = errors.New("open file failed: " + fpath)
-		return
-	}
-
-	if _, err = fp.Seek(offset, whence); err != nil {
-		err = errors.New("seek file failed: " + fpath)
-		return
-	}
-
-	reader = bufio.NewReaderSize(fp, 16*1024)
-	return
-}
-
-func readline(reader *bufio.Reader, buffer *bytes.Buffer) (line string, size int, err error) {
-	var (
-		segment []byte
-	)
-
-	for {
-		if segment, err = reader.ReadBytes('\n'); err != nil {
-			if err != io.EOF {
-				err = errors.New("read line failed")
-			}
-			return
-		}
-
-		if _, err = buffer.Write(segment); err != nil {
-			err = errors.New("write buffer failed")
-			return
-		}
-
-		if isPartialLine(segment) {
-			time.Sleep(1 * time.Second)
-		} else {
-			size = buffer.Len()
-			line = buffer.String()
-			buffer.Reset()
-			line = strings.TrimRight(line, "\r\n")
-			return
-		}
-	}
-
-	return
-}
-
-func isPartialLine(segment []byte) bool {
-	if len(segment) < 1 {
-		return true
-	}
-	if segment[len(segment)-1] != '\n' {
-		return true
+//输出没有换行符的最后一行, 返回新的读取位置
+func (self *FileInputService) pushTail(src *eventSource, reader *lineReader, since *SinceDBInfo, offset int64) int64 {
+	if line, size, cut, ok := reader.tail(); ok && self.pushLine(src, line, cut, offset) {
+		offset += int64(size)
+		self.setSinceDBOffset(since, offset)
 	}
-	return false
-}
-
-var (
-	mapWatcher = map[string]*fsnotify.Watcher{}
-)
-
-func waitWatchEvent(fpath string, op fsnotify.Op) (event fsnotify.Event, err error) {
-	var (
-		fdir    string
-		watcher *fsnotify.Watcher
-		ok      bool
-	)
-
-	if fpath, err = filepath.EvalSymlinks(fpath); err != nil {
-		err = errors.New("Get symlinks failed: " + fpath)
-		return
-	}
-
-	fdir = filepath.Dir(fpath)
-
-	if watcher, ok = mapWatcher[fdir]; !ok {
-		if watcher, err = fsnotify.NewWatcher(); err != nil {
-			err = errors.New("create new watcher failed: " + fdir)
-			return
-		}
-		mapWatcher[fdir] = watcher
-		if err = watcher.Add(fdir); err != nil {
-			err = errors.New("add new watch path failed: " + fdir)
-			return
-		}
-	}
-
-	for {
-		select {
-		case event = <-watcher.Events:
-			if event.Name == fpath {
-				if op > 0 {
-					if event.Op&op > 0 {
-						return
-					}
-				} else {
-					return
-				}
-			}
-		case err = <-watcher.Errors:
-			err = errors.New("watcher error")
-			return
-		}
-	}
-	return
+	return offset
 }
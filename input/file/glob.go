@@ -0,0 +1,105 @@
+package input
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//路径模式
+//在 filepath.Glob 的基础上支持 `**`, 匹配零个或多个目录, 例如 /data/logs/**/*.log
+//含有 `**` 的模式从第一个含有通配符的目录开始遍历, 只匹配文件, 遍历到的目录都需要监听, 子目录中新创建的文件也能发现
+
+const globstar = "**"
+
+//是否含有通配符
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+//展开路径模式, 返回匹配的路径与需要监听的目录
+func globPattern(pattern string) (matches []string, dirs []string, err error) {
+	if !strings.Contains(pattern, globstar) {
+		if matches, err = filepath.Glob(pattern); err != nil {
+			return
+		}
+		dirs, _ = filepath.Glob(filepath.Dir(pattern))
+		return
+	}
+
+	//校验每一段的语法
+	for _, seg := range strings.Split(pattern, string(filepath.Separator)) {
+		if _, err = filepath.Match(seg, ""); err != nil {
+			return
+		}
+	}
+
+	root := globRoot(pattern)
+	err = filepath.Walk(root, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			//没有权限等无法读取的目录跳过
+			if fi != nil && fi.IsDir() && fpath != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			dirs = append(dirs, fpath)
+		} else if matchPattern(pattern, fpath) {
+			matches = append(matches, fpath)
+		}
+		return nil
+	})
+	return
+}
+
+//模式中第一个含有通配符的目录之前的部分
+func globRoot(pattern string) string {
+	segs := strings.Split(pattern, string(filepath.Separator))
+	i := 0
+	for i < len(segs)-1 && !hasMeta(segs[i]) {
+		i++
+	}
+	root := strings.Join(segs[:i], string(filepath.Separator))
+	if root == "" {
+		if filepath.IsAbs(pattern) {
+			return string(filepath.Separator)
+		}
+		return "."
+	}
+	return root
+}
+
+//路径是否匹配模式, 模式中的 `**` 匹配零个或多个目录
+func matchPattern(pattern, name string) bool {
+	sep := string(filepath.Separator)
+	return matchSegments(strings.Split(filepath.Clean(pattern), sep), strings.Split(filepath.Clean(name), sep))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == globstar {
+			//连续的 ** 与一个等价
+			for len(pattern) > 0 && pattern[0] == globstar {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
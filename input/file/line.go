@@ -0,0 +1,218 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"github.com/domac/mafio/codec"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//按行读取
+//
+//max_bytes             单行最大的字节数(默认 10MB), 超过的部分丢弃, 事件带有 truncated 标签,
+//                      没有换行符的文件占用的内存不会无限增长
+//binary                二进制内容(含有 \0 或者大量控制字符与无效的 UTF-8 字节)的处理: keep(默认) 原样输出, skip 丢弃, hex 按十六进制输出并带有 binary 标签
+//partial_line_timeout  文件末尾没有换行符的行等待超过这个时间(秒)后作为一个事件输出, 0(默认) 为一直等待
+
+const (
+	TagTruncated = "truncated"
+	TagBinary    = "binary"
+
+	BinaryKeep = "keep"
+	BinarySkip = "skip"
+	BinaryHex  = "hex"
+
+	defaultMaxBytes = 10 * 1024 * 1024
+)
+
+func checkBinaryMode(mode string) error {
+	switch mode {
+	case BinaryKeep, BinarySkip, BinaryHex:
+		return nil
+	}
+	return errors.New("file input binary must be keep, skip or hex, got " + mode)
+}
+
+type lineReader struct {
+	rd       io.Reader
+	reader   *bufio.Reader
+	charset  *codec.Charset
+	maxBytes int
+
+	buffer    bytes.Buffer //当前行保留的部分
+	dropped   int          //当前行超过 maxBytes 被丢弃的字节数
+	waitSince time.Time    //当前不完整的行开始等待后续数据的时间
+	afterTail bool         //已经输出了不完整的行, 之后读到的换行符属于这一行
+	tailEnd   bool         //读到的是已经输出的不完整的行的换行符, 不作为事件输出
+}
+
+func newLineReader(rd io.Reader, charset *codec.Charset, maxBytes int) *lineReader {
+	return &lineReader{
+		rd:       rd,
+		reader:   bufio.NewReaderSize(rd, 16*1024),
+		charset:  charset,
+		maxBytes: maxBytes,
+	}
+}
+
+//UTF-16 的文件按开头的 BOM 确定字节序与换行符, 其它字符集不变
+func charsetWithBOM(charset *codec.Charset, rd io.ReaderAt) *codec.Charset {
+	if charset == nil || !charset.IsUTF16() {
+		return charset
+	}
+	head := make([]byte, 2)
+	n, _ := rd.ReadAt(head, 0)
+	return charset.WithBOM(head[:n])
+}
+
+//读取一行并转换为 UTF-8, 返回的行不含换行符, size 为这一行在文件中的字节数
+//读到末尾时返回 io.EOF, 不完整的行保留, 等待后续数据
+func (self *lineReader) readline() (line string, size int, truncated bool, err error) {
+	var complete bool
+	//UTF-16 的换行符占两个字节, 需要按编码单元切分
+	if self.charset != nil && self.charset.IsUTF16() {
+		complete, err = self.readUnits(self.charset.Newline())
+	} else {
+		complete, err = self.readBytes()
+	}
+	if err != nil {
+		return
+	}
+	if !complete {
+		if self.pending() > 0 && self.waitSince.IsZero() {
+			self.waitSince = time.Now()
+		}
+		err = io.EOF
+		return
+	}
+	line, size, truncated = self.take()
+	return
+}
+
+func (self *lineReader) readBytes() (complete bool, err error) {
+	for {
+		segment, err := self.reader.ReadSlice('\n')
+		self.append(segment)
+		switch err {
+		case nil:
+			return true, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return false, nil
+		}
+		return false, errors.New("read line failed")
+	}
+}
+
+func (self *lineReader) readUnits(newline []byte) (complete bool, err error) {
+	for {
+		unit, err := self.reader.Peek(2)
+		if len(unit) < 2 {
+			if err == nil || err == bufio.ErrBufferFull || err == io.EOF {
+				return false, nil
+			}
+			return false, errors.New("read line failed")
+		}
+		self.append(unit)
+		self.reader.Discard(2)
+		if bytes.Equal(unit, newline) {
+			return true, nil
+		}
+	}
+}
+
+//保留不超过 maxBytes 的部分, UTF-16 的编码单元不会被拆开
+func (self *lineReader) append(b []byte) {
+	room := len(b)
+	if self.maxBytes > 0 && self.buffer.Len()+room > self.maxBytes {
+		room = self.maxBytes - self.buffer.Len()
+		if len(b) == 2 && room < 2 {
+			room = 0
+		}
+	}
+	self.buffer.Write(b[:room])
+	self.dropped += len(b) - room
+}
+
+//取出当前行
+func (self *lineReader) take() (line string, size int, truncated bool) {
+	raw := self.buffer.Bytes()
+	if self.charset != nil {
+		raw = self.charset.Decode(raw)
+	}
+	line = strings.TrimRight(string(raw), "\r\n")
+	size = self.buffer.Len() + self.dropped
+	truncated = self.dropped > 0
+	self.tailEnd = self.afterTail && line == ""
+	self.afterTail = false
+
+	self.buffer.Reset()
+	self.dropped = 0
+	self.waitSince = time.Time{}
+	return
+}
+
+//不完整的行的字节数
+func (self *lineReader) pending() int {
+	return self.buffer.Len() + self.dropped
+}
+
+//不完整的行等待后续数据的时间
+func (self *lineReader) waited() time.Duration {
+	if self.waitSince.IsZero() {
+		return 0
+	}
+	return time.Since(self.waitSince)
+}
+
+//取出没有换行符的最后一行, 没有时 ok 为 false
+func (self *lineReader) tail() (line string, size int, truncated bool, ok bool) {
+	if self.pending() == 0 {
+		return
+	}
+	line, size, truncated = self.take()
+	self.afterTail = true
+	return line, size, truncated, true
+}
+
+//文件截断并重新定位后, 丢弃已经读取的内容
+func (self *lineReader) reset() {
+	self.reader.Reset(self.rd)
+	self.buffer.Reset()
+	self.dropped = 0
+	self.waitSince = time.Time{}
+	self.afterTail = false
+}
+
+//是否为二进制内容: 含有 \0, 或者控制字符与无效的字符(包括字符集转换失败的替换字符)超过字符数的十分之一
+//非 UTF-8 编码的文本需要配置 charset, 否则也会被当作二进制内容
+func isBinary(line string) bool {
+	suspicious, runes := 0, 0
+	for _, r := range line {
+		runes++
+		switch {
+		case r == 0:
+			return true
+		case r < 0x20 && r != '\t' && r != '\r' && r != '\f' && r != '\v' && r != '\b', r == 0x7f, r == utf8.RuneError:
+			suspicious++
+		}
+	}
+	return suspicious*10 > runes
+}
+
+//按 binary 配置处理二进制内容, ok 为 false 时丢弃
+func (self *FileInputService) checkBinary(line string) (out string, binary bool, ok bool) {
+	if self.Binary == BinaryKeep || !isBinary(line) {
+		return line, false, true
+	}
+	if self.Binary == BinarySkip {
+		return "", true, false
+	}
+	return hex.EncodeToString([]byte(line)), true, true
+}
@@ -0,0 +1,194 @@
+package input
+
+import (
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"sync/atomic"
+)
+
+//事件的来源信息
+//每个事件带有以下字段, 解码后已经存在的同名字段(例如 json 日志中的 host)不覆盖:
+//	path         文件的绝对路径
+//	offset       事件第一行在文件中的位置(压缩文件为解压后的位置)
+//	inode        文件的 inode
+//	host         主机名
+//	agent_id     agent 的编号
+//	agent_group  agent 的所在组
+//以及配置的静态字段 fields 与标签 tags, 路径模式中配置的 fields 与 tags 与全局的合并, 同名字段以路径模式中的为准
+
+const (
+	FieldPath       = "path"
+	FieldOffset     = "offset"
+	FieldInode      = "inode"
+	FieldHost       = "host"
+	FieldAgentId    = "agent_id"
+	FieldAgentGroup = "agent_group"
+)
+
+//路径模式
+//paths 中的每一项可以是路径模式字符串, 也可以是带有 fields 与 tags 的对象:
+//	{"path": "/data/logs/nginx/*.log", "fields": {"service": "nginx"}, "tags": ["web"]}
+type PathPattern struct {
+	Path   string                 `json:"path"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	Tags   []string               `json:"tags,omitempty"`
+}
+
+//解析 paths 中的一项, 无效时返回 nil
+func parsePathPattern(item interface{}) *PathPattern {
+	switch v := item.(type) {
+	case string:
+		if v != "" {
+			return &PathPattern{Path: v}
+		}
+	case map[string]interface{}:
+		pattern := &PathPattern{}
+		pattern.Path, _ = v["path"].(string)
+		if pattern.Path == "" {
+			return nil
+		}
+		pattern.Fields, _ = v["fields"].(map[string]interface{})
+		pattern.Tags, _ = util.Interface2Stringslice(v["tags"])
+		return pattern
+	}
+	return nil
+}
+
+//文件读取协程中事件的来源
+type eventSource struct {
+	r         *fileReader
+	inode     uint64
+	assembler *codec.MultilineAssembler
+	start     int64    //多行合并中尚未输出的事件的起始位置
+	tags      []string //多行合并中尚未输出的行的标签
+}
+
+//解码一行并交给后续处理, offset 为这一行的起始位置, truncated 表示这一行超过 max_bytes 被截断
+//agent 退出时返回 false, 这一行没有发送, 读取位置不应该前进
+func (self *FileInputService) pushLine(src *eventSource, line string, truncated bool, offset int64) bool {
+	atomic.AddInt64(&self.linesRead, 1)
+
+	var tags []string
+	if truncated {
+		tags = append(tags, TagTruncated)
+	}
+	line, binary, ok := self.checkBinary(line)
+	if !ok {
+		atomic.AddInt64(&self.binarySkipped, 1)
+		return true
+	}
+	if binary {
+		tags = append(tags, TagBinary)
+	}
+
+	if src.assembler == nil {
+		pkt, _ := codec.DecodeLine(self.Codec, []byte(line))
+		return self.emit(src, pkt, offset, tags)
+	}
+
+	//合并完成的事件从尚未输出的第一行开始, 或者从当前行开始;
+	//当前行仍未输出时标签留给之后的事件, 否则在最后一个事件中
+	pending := src.assembler.Pending()
+	pkts := src.assembler.Push([]byte(line))
+	waiting := src.assembler.Pending()
+	for i, pkt := range pkts {
+		var pktTags []string
+		if i == 0 && pending {
+			pktTags = src.tags
+		}
+		if i == len(pkts)-1 && !waiting {
+			pktTags = append(pktTags, tags...)
+		}
+		start := offset
+		if i == 0 && pending {
+			start = src.start
+		}
+		if !self.emit(src, pkt, start, pktTags) {
+			return false
+		}
+	}
+	if !pending || len(pkts) > 0 {
+		src.start = offset
+		src.tags = nil
+	}
+	if waiting {
+		src.tags = append(src.tags, tags...)
+	}
+	return true
+}
+
+//关闭文件前输出未合并完的行, 并保存读取位置
+func (self *FileInputService) flushAssembler(src *eventSource) {
+	if src.assembler != nil {
+		if pkt := src.assembler.Flush(); pkt != nil {
+			self.emit(src, pkt, src.start, src.tags)
+			src.tags = nil
+		}
+	}
+	self.CheckSaveSinceDBInfos()
+}
+
+//等待后续行超时, 输出已合并的行
+func (self *FileInputService) flushExpired(src *eventSource) {
+	if pkt := src.assembler.FlushExpired(); pkt != nil {
+		self.emit(src, pkt, src.start, src.tags)
+		src.tags = nil
+	}
+}
+
+//添加来源信息与标签后发送, agent 退出时丢弃并返回 false
+func (self *FileInputService) emit(src *eventSource, pkt *p.Packet, offset int64, tags []string) bool {
+	for _, tag := range tags {
+		pkt.AddTag(tag)
+	}
+	setDefaultField(pkt, FieldPath, self.readerPath(src.r))
+	setDefaultField(pkt, FieldOffset, offset)
+	setDefaultField(pkt, FieldInode, src.inode)
+	setDefaultField(pkt, FieldHost, self.hostname)
+	setDefaultField(pkt, FieldAgentId, self.agentId)
+	setDefaultField(pkt, FieldAgentGroup, self.agentGroup)
+
+	//路径模式中的字段优先
+	if pattern := src.r.pattern; pattern != nil {
+		for k, v := range pattern.Fields {
+			setDefaultField(pkt, k, v)
+		}
+		for _, tag := range pattern.Tags {
+			pkt.AddTag(tag)
+		}
+	}
+	for k, v := range self.Fields {
+		setDefaultField(pkt, k, v)
+	}
+	for _, tag := range self.Tags {
+		pkt.AddTag(tag)
+	}
+
+	//Inchan 有空位时 select 也可能选中发送, 已经退出时不再发送
+	if self.exiting() {
+		return false
+	}
+	select {
+	case self.ctx.Agentd.Inchan <- pkt:
+		return true
+	case <-self.ctx.Agentd.GetExitCh():
+		return false
+	}
+}
+
+//agent 是否正在退出
+func (self *FileInputService) exiting() bool {
+	select {
+	case <-self.ctx.Agentd.GetExitCh():
+		return true
+	default:
+		return false
+	}
+}
+
+func setDefaultField(pkt *p.Packet, name string, v interface{}) {
+	if _, ok := pkt.Fields[name]; !ok {
+		pkt.SetField(name, v)
+	}
+}
@@ -0,0 +1,76 @@
+package input
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+//轮询模式
+//NFS 等网络文件系统以及部分容器的 overlay 文件系统收不到 inotify 的写入事件, 读到末尾后会一直等待,
+//轮询模式下读取协程每隔 poll_interval 秒检查一次文件:
+//	变大       继续读取新内容
+//	变小       文件被截断, 从头读取
+//	被替换     路径已经指向新的文件(inode 改变)或者文件已经删除, 立即重新扫描,
+//	           原来的文件读到末尾后停止, 新的文件从头读取
+//新文件由定期扫描发现, 关闭的不活跃文件也在定期扫描时重新打开
+//
+//watch_mode:
+//	auto      默认, 使用 inotify, 创建或者添加监听失败时改为轮询
+//	fsnotify  只使用 inotify
+//	poll      只使用轮询
+
+const (
+	WatchAuto     = "auto"
+	WatchFsnotify = "fsnotify"
+	WatchPoll     = "poll"
+
+	defaultPollInterval = time.Second
+)
+
+func checkWatchMode(mode string) error {
+	switch mode {
+	case WatchAuto, WatchFsnotify, WatchPoll:
+		return nil
+	}
+	return errors.New("file input watch_mode must be auto, fsnotify or poll, got " + mode)
+}
+
+//是否使用轮询
+func (self *FileInputService) isPolling() bool {
+	return atomic.LoadInt32(&self.polling) == 1
+}
+
+//目录监听不可用时, auto 模式改为轮询
+func (self *FileInputService) fallbackToPoll(err error) {
+	if self.WatchMode != WatchAuto {
+		self.ctx.Logger().Warnf("dir watcher - %s", err)
+		return
+	}
+	if atomic.CompareAndSwapInt32(&self.polling, 0, 1) {
+		self.ctx.Logger().Warnf("dir watcher unavailable, poll files every %s - %s", self.PollInterval, err)
+	}
+}
+
+//读取协程等待新内容的轮询周期, 不轮询时为 nil
+func (self *FileInputService) pollWait() <-chan time.Time {
+	if !self.isPolling() {
+		return nil
+	}
+	return time.After(self.PollInterval)
+}
+
+//轮询时检查路径是否已经指向其他文件, 是则请求重新扫描
+func (self *FileInputService) checkReplaced(r *fileReader) {
+	fpath := self.readerPath(r)
+	fi, err := os.Stat(fpath)
+	if err == nil && sinceDBKey(fpath, fi) == r.key {
+		return
+	}
+	self.ctx.Logger().Debugf("File replaced or removed, rescan: %q", fpath)
+	select {
+	case self.rescan <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,370 @@
+package input
+
+import (
+	"errors"
+	"github.com/go-fsnotify/fsnotify"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//文件发现
+//启动后周期性地重新展开路径模式(stdFilePath 与 paths), 模式所在目录有新文件创建时也立即扫描:
+//新匹配的文件启动读取, 已经不存在或者不再匹配的文件读到末尾后停止读取,
+//匹配 exclude_files 中任意一个正则的路径不读取
+//
+//文件按标识(设备号与 inode)区分, 改名后仍然匹配的文件继续由原来的读取协程读取,
+//例如 logrotate 把 app.log 改名为 app.log.1 后, 新的 app.log 作为新文件从头读取
+//
+//资源限制:
+//	close_inactive  超过这个时间(秒)没有新内容的文件关闭, 有新内容时重新打开
+//	max_open_files  同时打开的文件数, 超过时新文件等待其他文件关闭后再打开
+//	ignore_older    最后修改时间早于这个时间(秒)的文件不打开, 之后有新内容时从当时的末尾开始读取
+
+const (
+	defaultScanInterval  = 10
+	defaultCloseInactive = 300
+)
+
+//匹配的文件
+//读取协程因为不活跃退出后记录保留, 文件有新内容时重新启动读取协程
+type fileReader struct {
+	key     string       //文件标识, 同 sincedb 的键
+	path    string       //当前路径, 文件改名后由扫描更新
+	pattern *PathPattern //第一次匹配的路径模式, 之后不再改变
+	active  bool         //读取协程正在运行, 文件处于打开状态
+	events  chan fsnotify.Event
+	stop    chan struct{} //关闭后读到末尾即停止
+}
+
+//扫描一次路径模式, 返回需要监听的目录
+//startPos 为新文件的起始读取位置, 启动时按配置, 之后发现的文件都从头读取
+func (self *FileInputService) scan(startPos string) (dirs map[string]bool) {
+	files, dirs := self.matchedFiles()
+
+	found := map[string]bool{}
+	waiting := 0
+	for _, f := range files {
+		found[f.key] = true
+		dirs[filepath.Dir(f.path)] = true
+		self.touchSinceDBInfo(f.key, f.path)
+		if !self.startReader(f.key, f.path, f.pattern, f.fi, startPos) {
+			waiting++
+		}
+	}
+	if waiting > 0 {
+		self.ctx.Logger().Warnf("max_open_files (%d) reached, %d files waiting to be opened", self.MaxOpenFiles, waiting)
+	}
+
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+	for key, r := range self.readers {
+		if !found[key] {
+			if r.active {
+				self.ctx.Logger().Infof("File disappeared, stop reading after EOF: %q", r.path)
+			}
+			self.removeReader(r)
+		}
+	}
+	return
+}
+
+//匹配的文件
+type matchedFile struct {
+	key     string
+	path    string //解析符号链接后的绝对路径
+	pattern *PathPattern
+	fi      os.FileInfo
+}
+
+//展开路径模式, 返回匹配的文件与需要监听的目录
+//排除 exclude_files 与目录, 同一个文件(硬链接)只按第一个路径读取
+func (self *FileInputService) matchedFiles() (files []matchedFile, dirs map[string]bool) {
+	matches, dirs := self.expandPaths()
+
+	found := map[string]bool{}
+	for _, match := range matches {
+		if self.excluded(match.path) {
+			continue
+		}
+
+		fpath, err := filepath.EvalSymlinks(match.path)
+		if err != nil {
+			self.ctx.Logger().Errorf("Get symlinks failed: %q\n%v", match.path, err)
+			continue
+		}
+		if fpath, err = filepath.Abs(fpath); err != nil {
+			self.ctx.Logger().Errorf("Get absolute path failed: %q\n%v", match.path, err)
+			continue
+		}
+
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			self.ctx.Logger().Errorf("stat(%q) failed\n%s", fpath, err)
+			continue
+		}
+
+		//目录不读取, 每个目录只提示一次
+		if fi.IsDir() {
+			if !self.skippedDirs[fpath] {
+				self.skippedDirs[fpath] = true
+				self.ctx.Logger().Warnf("Path pattern matched a directory, skipped (use %q to read files in it): %q", filepath.Join(fpath, globstar, "*"), fpath)
+			}
+			continue
+		}
+
+		key := sinceDBKey(fpath, fi)
+		if found[key] {
+			continue
+		}
+		found[key] = true
+		files = append(files, matchedFile{key: key, path: fpath, pattern: match.pattern, fi: fi})
+	}
+	return
+}
+
+//匹配的路径
+type pathMatch struct {
+	path    string
+	pattern *PathPattern
+}
+
+//展开所有路径模式, 返回匹配的路径与需要监听的目录
+func (self *FileInputService) expandPaths() (matches []pathMatch, dirs map[string]bool) {
+	dirs = map[string]bool{}
+	for _, pattern := range self.Paths {
+		paths, patternDirs, err := globPattern(pattern.Path)
+		if err != nil {
+			self.ctx.Logger().Errorf("glob (%s) failed - %s", pattern.Path, err)
+			continue
+		}
+		for _, fpath := range paths {
+			matches = append(matches, pathMatch{path: fpath, pattern: pattern})
+		}
+		for _, dir := range patternDirs {
+			if dir, err := filepath.EvalSymlinks(dir); err == nil {
+				dirs[dir] = true
+			}
+		}
+	}
+	return
+}
+
+//路径模式所在的目录
+func (self *FileInputService) patternDirs() map[string]bool {
+	_, dirs := self.expandPaths()
+	return dirs
+}
+
+//路径是否匹配任意一个路径模式, 并且没有被排除
+func (self *FileInputService) matchPath(fpath string) bool {
+	if self.excluded(fpath) {
+		return false
+	}
+	for _, pattern := range self.Paths {
+		if matchPattern(pattern.Path, fpath) {
+			return true
+		}
+	}
+	return false
+}
+
+//路径是否匹配 exclude_files 中的正则
+func (self *FileInputService) excluded(fpath string) bool {
+	for _, re := range self.excludes {
+		if re.MatchString(fpath) {
+			return true
+		}
+	}
+	return false
+}
+
+//为匹配的文件启动读取
+//已经在读取的文件只更新路径, 不活跃的文件有新内容时重新打开
+//打开的文件数达到上限时返回 false, 等待之后的扫描
+func (self *FileInputService) startReader(key, fpath string, pattern *PathPattern, fi os.FileInfo, startPos string) bool {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	if r, ok := self.readers[key]; ok {
+		if r.path != fpath {
+			self.ctx.Logger().Infof("File renamed: %q -> %q", r.path, fpath)
+			delete(self.readerPaths, r.path)
+			self.readerPaths[fpath] = r
+			r.path = fpath
+		}
+		if !r.active && self.fileChanged(key, fi) {
+			self.ctx.Logger().Infof("File changed, reopen: %q", fpath)
+			return self.runReader(r, "beginning")
+		}
+		return true
+	}
+
+	if self.IgnoreOlder > 0 && time.Since(fi.ModTime()) > time.Duration(self.IgnoreOlder)*time.Second {
+		self.ignoreSinceDBInfo(key, fpath, fi)
+		return true
+	}
+
+	r := &fileReader{
+		key:     key,
+		path:    fpath,
+		pattern: pattern,
+		events:  make(chan fsnotify.Event, 10),
+		stop:    make(chan struct{}),
+	}
+	if !self.runReader(r, startPos) {
+		return false
+	}
+	self.readers[key] = r
+	self.readerPaths[fpath] = r
+	self.ctx.Logger().Infof("Start reading file: %q", fpath)
+	return true
+}
+
+//启动读取协程, 调用者需要持有 readersLock
+func (self *FileInputService) runReader(r *fileReader, startPos string) bool {
+	if r.active {
+		return true
+	}
+	if self.MaxOpenFiles > 0 && self.openFiles >= self.MaxOpenFiles {
+		return false
+	}
+	r.active = true
+	self.openFiles++
+
+	go func() {
+		inactive, err := self.fileReadLoop(r, startPos)
+		if err != nil {
+			self.ctx.Logger().Errorf("read file %q failed - %s", self.readerPath(r), err)
+		}
+		self.readerDone(r, inactive)
+	}()
+	return true
+}
+
+//读取协程退出
+//因为不活跃而关闭的文件保留记录; 其他情况移除记录, 之后的扫描可以重新开始读取
+func (self *FileInputService) readerDone(r *fileReader, inactive bool) {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	r.active = false
+	self.openFiles--
+	if inactive && self.readers[r.key] == r {
+		self.ctx.Logger().Infof("File inactive, closed: %q", r.path)
+		return
+	}
+	self.removeReader(r)
+}
+
+//移除文件的记录并通知读取协程停止, 调用者需要持有 readersLock
+func (self *FileInputService) removeReader(r *fileReader) {
+	if self.readers[r.key] != r {
+		return
+	}
+	delete(self.readers, r.key)
+	if self.readerPaths[r.path] == r {
+		delete(self.readerPaths, r.path)
+	}
+	close(r.stop)
+}
+
+//读取协程当前的文件路径
+func (self *FileInputService) readerPath(r *fileReader) string {
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+	return r.path
+}
+
+//周期性扫描, 并分发目录的事件:
+//文件创建、删除与改名时立即扫描, 文件写入时唤醒读取协程或者重新打开不活跃的文件
+func (self *FileInputService) scanLoop() {
+	ticker := time.NewTicker(time.Duration(self.ScanInterval) * time.Second)
+	defer ticker.Stop()
+
+	var (
+		watcher *dirWatcher
+		events  <-chan fsnotify.Event
+		errs    <-chan error
+		err     error
+	)
+	if !self.isPolling() {
+		if watcher, err = newDirWatcher(); err != nil {
+			self.fallbackToPoll(errors.New("create dir watcher failed: " + err.Error()))
+			watcher = nil
+		} else {
+			defer watcher.Close()
+			events, errs = watcher.watcher.Events, watcher.watcher.Errors
+			//先监听再扫描, 扫描期间创建的文件不会遗漏
+			if err = watcher.update(self.patternDirs()); err != nil {
+				self.fallbackToPoll(err)
+			}
+		}
+	}
+
+	//启动时已经存在的文件按 start_position 读取, 之后发现的文件从头读取
+	startPos := self.StartPos
+	for {
+		dirs := self.scan(startPos)
+		startPos = "beginning"
+		if watcher != nil {
+			if err = watcher.update(dirs); err != nil {
+				self.fallbackToPoll(err)
+			}
+		}
+
+	wait:
+		for {
+			select {
+			case <-ticker.C:
+				break wait
+			case <-self.rescan:
+				break wait
+			case event := <-events:
+				if self.dispatchEvent(event) {
+					break wait
+				}
+			case err := <-errs:
+				self.ctx.Logger().Warnf("dir watcher error - %s", err)
+			case <-self.ctx.Agentd.GetExitCh():
+				return
+			}
+		}
+	}
+}
+
+//分发目录的事件, 返回是否需要重新扫描
+func (self *FileInputService) dispatchEvent(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+		return true
+	}
+	if event.Op&fsnotify.Write == 0 {
+		return false
+	}
+
+	self.readersLock.Lock()
+	defer self.readersLock.Unlock()
+
+	r, ok := self.readerPaths[event.Name]
+	if !ok {
+		//还没有读取的文件有了新内容, 例如被 ignore_older 忽略的文件或者等待打开的文件
+		//打开的文件数已经达到上限时, 等待定期扫描
+		if self.MaxOpenFiles > 0 && self.openFiles >= self.MaxOpenFiles {
+			return false
+		}
+		return self.matchPath(event.Name)
+	}
+	if !r.active {
+		if !self.runReader(r, "beginning") {
+			return false
+		}
+		self.ctx.Logger().Infof("File changed, reopen: %q", r.path)
+		return false
+	}
+	//事件只用于唤醒读取协程, 读取协程每次都读到文件末尾, 来不及处理的事件可以丢弃
+	select {
+	case r.events <- event:
+	default:
+	}
+	return false
+}
@@ -2,22 +2,74 @@ package input
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/domac/mafio/util"
+	"io"
 	"io/ioutil"
+	"os"
+	"sort"
 	"time"
 )
 
 //本地文件since信息数据库
-//记录文件从哪里开始
+//按文件标识(设备号与 inode)记录读取位置, 文件改名后仍然能找到原来的位置,
+//同一路径下新创建的文件不会继承旧文件的位置
+//
+//文件格式:
+//	{"version": 2, "files": [{"path": "/data/logs/app.log", "device": 2049, "inode": 1234, "offset": 100, "last_seen": "..."}]}
+//
+//旧版本按路径记录的格式 {"/data/logs/app.log": {"offset": 100}} 载入时自动迁移
+//
+//多个文件的读取协程同时更新记录, 记录的读写都需要持有 sinceDBLock,
+//超过 sincedb_clean_after 秒没有出现过的文件的记录会被清理
 type SinceDBInfo struct {
+	Path        string    `json:"path"`
+	Device      uint64    `json:"device"`
+	Inode       uint64    `json:"inode"`
+	Fingerprint string    `json:"fingerprint,omitempty"` //文件开头若干字节的摘要, 用于识别 inode 被复用的新文件
+	Offset      int64     `json:"offset"`              //压缩文件为解压后的位置
+	Completed   bool      `json:"completed,omitempty"` //压缩文件已经读取完成, 不再读取
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+const (
+	sinceDBVersion           = 2
+	defaultSinceDBCleanAfter = 14 * 24 * 3600 //两周
+)
+
+type sinceDBFile struct {
+	Version int            `json:"version"`
+	Files   []*SinceDBInfo `json:"files"`
+}
+
+//版本1: 按路径记录
+type legacySinceDBInfo struct {
 	Offset int64 `json:"offset,omitempty"`
 }
 
+//文件在 sincedb 中的键
+//无法取得 inode 时按路径记录
+func sinceDBKey(fpath string, fi os.FileInfo) string {
+	device, inode := fileIdentity(fi)
+	return identityKey(fpath, device, inode)
+}
+
+func identityKey(fpath string, device, inode uint64) string {
+	if inode == 0 {
+		return fpath
+	}
+	return fmt.Sprintf("%d:%d", device, inode)
+}
+
 //载入diskdb
 func (self *FileInputService) LoadSinceDBInfos() (err error) {
 	var (
 		raw []byte
+		db  sinceDBFile
 	)
 	self.ctx.Logger().Debug("LoadSinceDBInfos")
 	self.SinceDBInfos = map[string]*SinceDBInfo{}
@@ -37,60 +89,265 @@ func (self *FileInputService) LoadSinceDBInfos() (err error) {
 		return
 	}
 
-	if err = json.Unmarshal(raw, &self.SinceDBInfos); err != nil {
-		self.ctx.Logger().Errorf("Unmarshal sincedb failed: %q\n%s", self.SinceDBPath, err)
+	if err = json.Unmarshal(raw, &db); err != nil || db.Version == 0 {
+		return self.migrateSinceDBInfos(raw)
+	}
+
+	if db.Version > sinceDBVersion {
+		err = fmt.Errorf("unsupported sincedb version %d", db.Version)
+		self.ctx.Logger().Errorf("Load sincedb failed: %q\n%s", self.SinceDBPath, err)
 		return
 	}
 
+	for _, since := range db.Files {
+		self.SinceDBInfos[identityKey(since.Path, since.Device, since.Inode)] = since
+	}
 	return
 }
 
-//周期性地保存文件位置信息到磁盘db
-func (self *FileInputService) SaveSinceDBInfos() (err error) {
+//从按路径记录的旧格式迁移, 按文件当前的 inode 记录, 已经不存在的文件丢弃
+func (self *FileInputService) migrateSinceDBInfos(raw []byte) (err error) {
 	var (
-		raw []byte
+		legacy map[string]*legacySinceDBInfo
+		fi     os.FileInfo
 	)
+	if err = json.Unmarshal(raw, &legacy); err != nil {
+		self.ctx.Logger().Errorf("Unmarshal sincedb failed: %q\n%s", self.SinceDBPath, err)
+		return
+	}
+
+	now := time.Now()
+	for fpath, info := range legacy {
+		if info == nil {
+			continue
+		}
+		if fi, err = os.Stat(fpath); err != nil {
+			self.ctx.Logger().Infof("sincedb migrate: drop missing file %q", fpath)
+			continue
+		}
+		since := &SinceDBInfo{Path: fpath, Offset: info.Offset, LastSeen: now}
+		since.Device, since.Inode = fileIdentity(fi)
+		self.SinceDBInfos[sinceDBKey(fpath, fi)] = since
+	}
+	err = nil
+	self.ctx.Logger().Infof("sincedb migrated to version %d: %d files", sinceDBVersion, len(self.SinceDBInfos))
+	return
+}
+
+//文件的读取位置记录, 没有记录时新建
+func (self *FileInputService) sinceDBInfo(key, fpath string, fi os.FileInfo) *SinceDBInfo {
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+
+	since, ok := self.SinceDBInfos[key]
+	if !ok {
+		since = &SinceDBInfo{}
+		since.Device, since.Inode = fileIdentity(fi)
+		self.SinceDBInfos[key] = since
+	}
+	since.Path = fpath
+	since.LastSeen = time.Now()
+	return since
+}
+
+//扫描时更新文件的路径与最后出现的时间
+func (self *FileInputService) touchSinceDBInfo(key, fpath string) {
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	if since, ok := self.SinceDBInfos[key]; ok {
+		since.Path = fpath
+		since.LastSeen = time.Now()
+	}
+}
+
+//被 ignore_older 忽略的文件, 没有记录时记录当前的末尾, 之后有新内容时只读取新的部分
+func (self *FileInputService) ignoreSinceDBInfo(key, fpath string, fi os.FileInfo) {
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	if _, ok := self.SinceDBInfos[key]; ok {
+		return
+	}
+	since := &SinceDBInfo{Path: fpath, Offset: fi.Size(), LastSeen: time.Now()}
+	since.Device, since.Inode = fileIdentity(fi)
+	self.SinceDBInfos[key] = since
+}
+
+//文件大小与记录的读取位置不同, 说明关闭后有新内容或者被截断
+func (self *FileInputService) fileChanged(key string, fi os.FileInfo) bool {
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	since, ok := self.SinceDBInfos[key]
+	if ok && since.Completed {
+		return false
+	}
+	return !ok || since.Offset != fi.Size()
+}
+
+//压缩文件读取完成
+func (self *FileInputService) completeSinceDBInfo(since *SinceDBInfo) {
+	self.sinceDBLock.Lock()
+	since.Completed = true
+	self.sinceDBLock.Unlock()
+}
+
+//记录的读取位置, 没有记录时为 0
+func (self *FileInputService) sinceDBOffset(key string) int64 {
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	if since, ok := self.SinceDBInfos[key]; ok {
+		return since.Offset
+	}
+	return 0
+}
+
+//更新读取位置
+func (self *FileInputService) setSinceDBOffset(since *SinceDBInfo, offset int64) {
+	self.sinceDBLock.Lock()
+	since.Offset = offset
+	self.sinceDBLock.Unlock()
+}
+
+//清理超过 SinceDBCleanAfter 秒没有出现过的文件的记录, 正在读取的文件保留
+func (self *FileInputService) cleanSinceDBInfos() {
+	if self.SinceDBCleanAfter <= 0 {
+		return
+	}
+
+	self.readersLock.Lock()
+	reading := make(map[string]bool, len(self.readers))
+	for key := range self.readers {
+		reading[key] = true
+	}
+	self.readersLock.Unlock()
+
+	expire := time.Duration(self.SinceDBCleanAfter) * time.Second
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	for key, since := range self.SinceDBInfos {
+		if !reading[key] && time.Since(since.LastSeen) > expire {
+			self.ctx.Logger().Infof("sincedb: clean expired file %q, last seen at %s", since.Path, since.LastSeen.Format(time.RFC3339))
+			delete(self.SinceDBInfos, key)
+		}
+	}
+}
+
+//文件开头 n 个字节的摘要, 文件不足 n 个字节时为空
+func fingerprint(fp *os.File, n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := fp.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			return "", nil
+		}
+		return "", errors.New("read fingerprint failed: " + fp.Name())
+	}
+	sum := md5.Sum(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//开启指纹校验时, 文件开头与记录不一致说明 inode 被新文件复用, 从头读取
+func (self *FileInputService) checkFingerprint(fp *os.File, since *SinceDBInfo) error {
+	if self.FingerprintBytes <= 0 {
+		return nil
+	}
+	sum, err := fingerprint(fp, self.FingerprintBytes)
+	if err != nil || sum == "" {
+		return err
+	}
+
+	self.sinceDBLock.Lock()
+	defer self.sinceDBLock.Unlock()
+	if since.Fingerprint != "" && since.Fingerprint != sum {
+		self.ctx.Logger().Warnf("File fingerprint changed, seeking to beginning: %q", fp.Name())
+		since.Offset = 0
+	}
+	since.Fingerprint = sum
+	return nil
+}
+
+//调用者需要持有 sinceDBLock
+func (self *FileInputService) marshalSinceDBInfos() ([]byte, error) {
+	keys := make([]string, 0, len(self.SinceDBInfos))
+	for key := range self.SinceDBInfos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	db := sinceDBFile{Version: sinceDBVersion, Files: make([]*SinceDBInfo, 0, len(keys))}
+	for _, key := range keys {
+		db.Files = append(db.Files, self.SinceDBInfos[key])
+	}
+	return json.Marshal(db)
+}
+
+//保存文件位置信息到磁盘db
+//先写临时文件并同步到磁盘再改名覆盖, 保存过程中退出不会损坏原来的 sincedb
+func (self *FileInputService) SaveSinceDBInfos() (err error) {
 	self.ctx.Logger().Debug("save file watch offset record")
+
+	self.sinceDBLock.Lock()
 	self.SinceDBLastSaveTime = time.Now()
+	self.sinceDBLock.Unlock()
+	return self.writeSinceDBInfos(true)
+}
 
+//force 为 false 时内容没有变化不写入
+func (self *FileInputService) writeSinceDBInfos(force bool) (err error) {
+	var (
+		raw []byte
+	)
 	if self.SinceDBPath == "" || self.SinceDBPath == "/dev/null" {
 		self.ctx.Logger().Warnf("No valid sincedb path")
 		return
 	}
 
-	if raw, err = json.Marshal(self.SinceDBInfos); err != nil {
+	//多个协程同时保存时按顺序写入, 在保存锁内生成内容, 较早的内容不会覆盖较新的内容
+	self.sinceDBSaveLock.Lock()
+	defer self.sinceDBSaveLock.Unlock()
+
+	self.sinceDBLock.Lock()
+	raw, err = self.marshalSinceDBInfos()
+	changed := !bytes.Equal(raw, self.sinceDBLastInfosRaw)
+	self.sinceDBLock.Unlock()
+	if err != nil {
 		self.ctx.Logger().Errorf("Marshal sincedb failed: %s", err)
 		return
 	}
-	self.sinceDBLastInfosRaw = raw
+	if !force && !changed {
+		return
+	}
 
-	if err = ioutil.WriteFile(self.SinceDBPath, raw, 0664); err != nil {
+	if err = util.WriteFileAtomic(self.SinceDBPath, raw, 0664); err != nil {
 		self.ctx.Logger().Errorf("Write sincedb failed: %q\n%s", self.SinceDBPath, err)
 		return
 	}
 
+	self.sinceDBLock.Lock()
+	self.sinceDBLastInfosRaw = raw
+	self.sinceDBLock.Unlock()
 	return
 }
 
+//距离上次保存超过 SinceDBWriteInterval 秒且内容有变化时保存
+//批量模式在输出发送完成后才保存
 func (self *FileInputService) CheckSaveSinceDBInfos() (err error) {
-	var (
-		raw []byte
-	)
-	if time.Since(self.SinceDBLastSaveTime) > time.Duration(self.SinceDBWriteInterval)*time.Second {
-		if raw, err = json.Marshal(self.SinceDBInfos); err != nil {
-			self.ctx.Logger().Errorf("Marshal sincedb failed: %s", err)
-			return
-		}
-		if bytes.Compare(raw, self.sinceDBLastInfosRaw) != 0 {
-			err = self.SaveSinceDBInfos()
-		}
+	if self.Mode == ModeBatch {
+		return
 	}
-	return
+	self.sinceDBLock.Lock()
+	if time.Since(self.SinceDBLastSaveTime) <= time.Duration(self.SinceDBWriteInterval)*time.Second {
+		self.sinceDBLock.Unlock()
+		return
+	}
+	//先更新保存时间, 其他读取协程不再重复保存
+	self.SinceDBLastSaveTime = time.Now()
+	self.sinceDBLock.Unlock()
+	return self.writeSinceDBInfos(false)
 }
 
 func (self *FileInputService) CheckSaveSinceDBInfosLoop() (err error) {
 	for {
 		time.Sleep(time.Duration(self.SinceDBWriteInterval) * time.Second)
+		self.cleanSinceDBInfos()
 		if err = self.CheckSaveSinceDBInfos(); err != nil {
 			return
 		}
@@ -0,0 +1,48 @@
+package input
+
+import (
+	"errors"
+	"github.com/go-fsnotify/fsnotify"
+)
+
+//目录监听
+//所有目录共用一个 fsnotify watcher, 每个目录只监听一次, 事件由扫描协程统一分发给各个文件,
+//不再需要的目录(不再匹配路径模式, 并且没有匹配的文件)取消监听
+type dirWatcher struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &dirWatcher{watcher: watcher, dirs: map[string]bool{}}, nil
+}
+
+//更新监听的目录, 添加失败的目录在下次更新时重试
+func (self *dirWatcher) update(dirs map[string]bool) (err error) {
+	for dir := range dirs {
+		if self.dirs[dir] {
+			continue
+		}
+		if e := self.watcher.Add(dir); e != nil {
+			err = errors.New("add new watch path failed: " + dir)
+			continue
+		}
+		self.dirs[dir] = true
+	}
+	for dir := range self.dirs {
+		if !dirs[dir] {
+			//目录已经删除时内核会自动取消监听, 忽略错误
+			self.watcher.Remove(dir)
+			delete(self.dirs, dir)
+		}
+	}
+	return
+}
+
+func (self *dirWatcher) Close() error {
+	return self.watcher.Close()
+}
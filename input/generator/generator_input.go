@@ -0,0 +1,245 @@
+package generator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
+	"github.com/domac/mafio/util"
+	"math/rand"
+	"os"
+	"reflect"
+	"text/template"
+	"time"
+)
+
+const ModuleName = "generator"
+
+//压测用的事件生成器
+//按模板生成事件, 可以限制速率、总数与持续时间, 结束时报告实际的吞吐量
+//
+//模板使用 text/template 语法, 可用的数据:
+//	.Seq        序号, 从1开始
+//	.Time       生成时间 (time.Time)
+//	.Timestamp  生成时间 (RFC3339)
+//	.Unix       生成时间 (unix 秒)
+//	.Host       主机名
+//可用的函数:
+//	randInt min max      [min, max] 之间的随机整数
+//	randFloat min max    [min, max) 之间的随机小数
+//	randChoice a b ...   随机选择一个参数
+//	randString n         长度为 n 的随机字母数字串
+type GeneratorInputService struct {
+	ctx *a.Context
+
+	templates []*template.Template
+	codec     string
+	rate      float64       //每秒生成的事件数, 0 表示不限速
+	count     int64         //生成的事件总数, 0 表示不限制
+	duration  time.Duration //持续时间, 0 表示不限制
+	exit      bool          //生成结束后, 等待输出发送完成再退出
+
+	rand *rand.Rand
+}
+
+//模板数据
+type templateData struct {
+	Seq       int64
+	Time      time.Time
+	Timestamp string
+	Unix      int64
+	Host      string
+}
+
+func New() *GeneratorInputService {
+	return &GeneratorInputService{}
+}
+
+func (self *GeneratorInputService) SetContext(ctx *a.Context) {
+	self.ctx = ctx
+}
+
+func (self *GeneratorInputService) Reflesh() {
+
+}
+
+//可通过命令行覆盖的配置项
+func (self *GeneratorInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"templates":      reflect.Slice,
+		"codec":          reflect.String,
+		"rate":           reflect.Float64,
+		"count":          reflect.Float64,
+		"duration":       reflect.Float64,
+		"exit_on_finish": reflect.Bool,
+	}
+}
+
+//读取插件配置
+func (self *GeneratorInputService) loadConfig() error {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if !ok {
+		return errors.New("generator input config not found")
+	}
+
+	texts, _ := util.Interface2Stringslice(configMap["templates"])
+	if len(texts) == 0 {
+		return errors.New("generator input config-templates not found")
+	}
+
+	self.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	funcs := template.FuncMap{
+		"randInt":    self.randInt,
+		"randFloat":  self.randFloat,
+		"randChoice": self.randChoice,
+		"randString": self.randString,
+	}
+	self.templates = nil
+	for i, text := range texts {
+		tpl, err := template.New(fmt.Sprintf("templates[%d]", i)).Funcs(funcs).Parse(text)
+		if err != nil {
+			return err
+		}
+		self.templates = append(self.templates, tpl)
+	}
+
+	self.codec, _ = configMap["codec"].(string)
+	if _, err := codec.DecodeLine(self.codec, nil); err != nil {
+		return err
+	}
+	self.rate, _ = configMap["rate"].(float64)
+	count, _ := configMap["count"].(float64)
+	self.count = int64(count)
+	duration, _ := configMap["duration"].(float64)
+	self.duration = time.Duration(duration * float64(time.Second))
+	self.exit = true
+	if v, ok := configMap["exit_on_finish"].(bool); ok {
+		self.exit = v
+	}
+	return nil
+}
+
+func (self *GeneratorInputService) randInt(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + self.rand.Intn(max-min+1)
+}
+
+func (self *GeneratorInputService) randFloat(min, max float64) float64 {
+	return min + self.rand.Float64()*(max-min)
+}
+
+func (self *GeneratorInputService) randChoice(choices ...interface{}) interface{} {
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[self.rand.Intn(len(choices))]
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func (self *GeneratorInputService) randString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[self.rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func (self *GeneratorInputService) StartInput() {
+	if err := self.loadConfig(); err != nil {
+		self.ctx.Logger().Errorf("generator input fail: %s", err)
+		os.Exit(2)
+	}
+	self.ctx.Logger().Infof("plugins input generator, %d templates, rate: %.0f/s, count: %d, duration: %s",
+		len(self.templates), self.rate, self.count, self.duration)
+
+	var (
+		seq      int64
+		finished bool
+		buf      bytes.Buffer
+		host, _  = os.Hostname()
+		start    = time.Now()
+		exitCh   = self.ctx.Agentd.GetExitCh()
+	)
+
+	//限速时每个周期补齐到应生成的数量
+	var tick <-chan time.Time
+	if self.rate > 0 {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		if self.count > 0 && seq >= self.count {
+			break
+		}
+		if self.duration > 0 && time.Since(start) >= self.duration {
+			break
+		}
+
+		batch := int64(1)
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-exitCh:
+				goto exit
+			}
+			batch = int64(self.rate*time.Since(start).Seconds()) - seq
+			if self.count > 0 && seq+batch > self.count {
+				batch = self.count - seq
+			}
+		}
+
+		for i := int64(0); i < batch; i++ {
+			seq++
+			now := time.Now()
+			data := &templateData{
+				Seq:       seq,
+				Time:      now,
+				Timestamp: now.Format(time.RFC3339),
+				Unix:      now.Unix(),
+				Host:      host,
+			}
+			buf.Reset()
+			tpl := self.templates[(seq-1)%int64(len(self.templates))]
+			if err := tpl.Execute(&buf, data); err != nil {
+				self.ctx.Logger().Errorf("generator render %s failed - %s", tpl.Name(), err)
+				continue
+			}
+			pkt, _ := codec.DecodeLine(self.codec, append([]byte(nil), buf.Bytes()...))
+			select {
+			case self.ctx.Agentd.Inchan <- pkt:
+			case <-exitCh:
+				goto exit
+			}
+		}
+	}
+
+	finished = true
+	self.report("generated", seq, time.Since(start))
+	if self.exit {
+		go func() {
+			if self.ctx.Agentd.WaitFlushed() {
+				self.report("flushed", seq, time.Since(start))
+				self.ctx.Agentd.ExitAfterFlush()
+			}
+		}()
+	}
+	<-exitCh
+
+exit:
+	if !finished {
+		self.report("stopped after", seq, time.Since(start))
+	}
+	self.ctx.Logger().Warning("input close")
+}
+
+//报告吞吐量
+func (self *GeneratorInputService) report(stage string, n int64, elapsed time.Duration) {
+	rate := float64(n) / elapsed.Seconds()
+	self.ctx.Logger().Infof("[GENERATOR]%s %d events in %s, %.1f events/s", stage, n, elapsed, rate)
+}
@@ -0,0 +1,360 @@
+package httpin
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const ModuleName = "http"
+
+//HTTP 输入
+//与管理 API 分开监听, 接收 POST 到 path 的事件:
+//
+//	address          监听地址
+//	path             接收事件的路径, 默认 /
+//	codec            请求体的解码: json(默认) 支持单个对象、对象数组以及每行一个对象(NDJSON), line 为每行一个事件
+//	tokens           Authorization: Bearer <token> 中允许的 token, 为空时不校验
+//	max_body_size    解压后请求体的最大字节数(默认 10MB), 超过时返回 413
+//	enqueue_timeout  输入队列剩余空间不足时等待的时间(秒, 默认 1), 超时返回 429
+//	tls_cert         启用 TLS 的证书与私钥(tls_key), 配置 tls_ca 时要求客户端提供由该 CA 签发的证书
+//
+//请求体可以是 gzip 或 zstd 压缩的(Content-Encoding), 一个请求的事件要么全部进入输入队列并返回 200,
+//要么都不进入: 等待超时返回 429, 客户端应该按 Retry-After 稍后重试; 事件数超过队列大小(max-read-channel-size)的请求返回 413
+type HTTPInputService struct {
+	ctx *a.Context
+
+	Address        string
+	Path           string
+	Codec          string
+	MaxBodySize    int64
+	EnqueueTimeout time.Duration
+	TLSCert        string
+	TLSKey         string
+	TLSCA          string
+
+	tokens      [][]byte
+	server      *http.Server
+	enqueueLock chan struct{} //同一时间只有一个请求向输入队列发送
+}
+
+const (
+	FieldRemoteAddr = "remote_addr"
+
+	defaultMaxBodySize    = 10 * 1024 * 1024
+	defaultEnqueueTimeout = time.Second
+	enqueueCheckInterval  = 10 * time.Millisecond
+)
+
+func New() *HTTPInputService {
+	return &HTTPInputService{}
+}
+
+func (self *HTTPInputService) SetContext(ctx *a.Context) {
+	self.ctx = ctx
+	self.Path = "/"
+	self.Codec = codec.JSON
+	self.MaxBodySize = defaultMaxBodySize
+	self.EnqueueTimeout = defaultEnqueueTimeout
+	self.enqueueLock = make(chan struct{}, 1)
+}
+
+func (self *HTTPInputService) Reflesh() {
+
+}
+
+//可通过命令行覆盖的配置项
+func (self *HTTPInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"address":         reflect.String,
+		"path":            reflect.String,
+		"codec":           reflect.String,
+		"tokens":          reflect.Slice,
+		"max_body_size":   reflect.Float64,
+		"enqueue_timeout": reflect.Float64,
+		"tls_cert":        reflect.String,
+		"tls_key":         reflect.String,
+		"tls_ca":          reflect.String,
+	}
+}
+
+//读取插件配置
+func (self *HTTPInputService) loadConfig() error {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if !ok {
+		return errors.New("http input config not found")
+	}
+	self.Address, _ = configMap["address"].(string)
+	if v, ok := configMap["path"].(string); ok && v != "" {
+		self.Path = v
+	}
+	if v, ok := configMap["codec"].(string); ok && v != "" {
+		self.Codec = v
+	}
+	if v, ok := configMap["max_body_size"].(float64); ok && v > 0 {
+		self.MaxBodySize = int64(v)
+	}
+	if v, ok := configMap["enqueue_timeout"].(float64); ok && v >= 0 {
+		self.EnqueueTimeout = time.Duration(v * float64(time.Second))
+	}
+	self.TLSCert, _ = configMap["tls_cert"].(string)
+	self.TLSKey, _ = configMap["tls_key"].(string)
+	self.TLSCA, _ = configMap["tls_ca"].(string)
+	tokens, _ := util.Interface2Stringslice(configMap["tokens"])
+	for _, token := range tokens {
+		if token != "" {
+			self.tokens = append(self.tokens, []byte(token))
+		}
+	}
+
+	if self.Address == "" {
+		return errors.New("http input address not found")
+	}
+	switch self.Codec {
+	case codec.JSON, codec.JSONLines, codec.Line:
+	default:
+		return errors.New("http input codec must be json, json_lines or line, got " + self.Codec)
+	}
+	return nil
+}
+
+func (self *HTTPInputService) StartInput() {
+	if err := self.loadConfig(); err != nil {
+		self.ctx.Logger().Errorf("http input fail: %s", err)
+		os.Exit(2)
+	}
+	ln, err := self.listen()
+	if err != nil {
+		self.ctx.Logger().Errorf("http input fail: %s", err)
+		os.Exit(2)
+	}
+	if len(self.tokens) == 0 {
+		self.ctx.Logger().Warnf("http input has no tokens, requests are not authenticated")
+	}
+
+	self.server = &http.Server{
+		Handler:     self,
+		ReadTimeout: 60 * time.Second,
+		ErrorLog:    log.New(errorLogWriter{self.ctx.Logger()}, "", 0),
+	}
+	go func() {
+		<-self.ctx.Agentd.GetExitCh()
+		self.server.Close()
+	}()
+	if err := self.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		self.ctx.Logger().Errorf("http input serve failed - %s", err)
+	}
+	self.ctx.Logger().Infoln("http input exit")
+}
+
+func (self *HTTPInputService) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", self.Address)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s - %s", self.Address, err)
+	}
+	protocol := "http"
+	if self.TLSCert != "" || self.TLSKey != "" {
+		config, err := util.NewServerTLSConfig(self.TLSCert, self.TLSKey, self.TLSCA)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = tls.NewListener(ln, config)
+		protocol = "https"
+	}
+	self.ctx.Logger().Infof("plugins input http, listen on %s://%s%s, codec: %s", protocol, ln.Addr(), self.Path, self.Codec)
+	return ln, nil
+}
+
+//http.Server 的错误日志(例如 TLS 握手失败)写入 agent 的日志
+type errorLogWriter struct {
+	logger a.Logger
+}
+
+func (self errorLogWriter) Write(b []byte) (int, error) {
+	self.logger.Warnf("http input %s", strings.TrimSpace(string(b)))
+	return len(b), nil
+}
+
+type response struct {
+	Accepted int    `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+func reply(w http.ResponseWriter, code int, accepted int, err error) {
+	resp := response{Accepted: accepted}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (self *HTTPInputService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != self.Path {
+		reply(w, http.StatusNotFound, 0, errors.New("not found"))
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(w, http.StatusMethodNotAllowed, 0, errors.New("only POST is allowed"))
+		return
+	}
+	if !self.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mafio"`)
+		reply(w, http.StatusUnauthorized, 0, errors.New("invalid or missing bearer token"))
+		return
+	}
+
+	packets, status, err := self.readEvents(req)
+	if err != nil {
+		self.ctx.Logger().Debugf("http input request from %s rejected - %s", req.RemoteAddr, err)
+		reply(w, status, 0, err)
+		return
+	}
+
+	if size := cap(self.ctx.Agentd.Inchan); len(packets) > size {
+		reply(w, http.StatusRequestEntityTooLarge, 0, fmt.Errorf("%d events exceed the input queue size %d", len(packets), size))
+		return
+	}
+	err = self.enqueue(packets)
+	switch {
+	case err == errExiting:
+		reply(w, http.StatusServiceUnavailable, 0, err)
+	case err != nil:
+		w.Header().Set("Retry-After", "1")
+		reply(w, http.StatusTooManyRequests, 0, err)
+	default:
+		reply(w, http.StatusOK, len(packets), nil)
+	}
+}
+
+//校验 Authorization: Bearer <token>
+func (self *HTTPInputService) authorized(req *http.Request) bool {
+	if len(self.tokens) == 0 {
+		return true
+	}
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return false
+	}
+	token := []byte(strings.TrimSpace(auth[7:]))
+	for _, t := range self.tokens {
+		if subtle.ConstantTimeCompare(token, t) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+//解压并解码请求体, 出错时返回对应的状态码
+func (self *HTTPInputService) readEvents(req *http.Request) ([]*p.Packet, int, error) {
+	var body io.Reader = req.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case codec.CompressGzip, codec.CompressZstd:
+		rc, err := codec.NewDecompressReader(req.Body, encoding)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid %s body - %s", encoding, err)
+		}
+		defer rc.Close()
+		body = rc
+	default:
+		return nil, http.StatusUnsupportedMediaType, errors.New("unsupported content encoding: " + encoding)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, self.MaxBodySize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("read body failed - %s", err)
+	}
+	if int64(len(data)) > self.MaxBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body larger than %d bytes", self.MaxBodySize)
+	}
+
+	decoder, err := codec.NewDecoder(self.Codec, bytes.NewReader(data), len(data))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	var packets []*p.Packet
+	for {
+		pkt, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != codec.ErrLineTooLong {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid %s body - %s", self.Codec, err)
+		}
+		//json_lines 与 line 的空行
+		if len(pkt.Data) == 0 && len(pkt.Fields) == 0 {
+			continue
+		}
+		if pkt.HasTag(codec.TagJSONParseFailure) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid %s body - %s", self.Codec, pkt.Data)
+		}
+		if _, ok := pkt.Fields[FieldRemoteAddr]; !ok {
+			pkt.SetField(FieldRemoteAddr, req.RemoteAddr)
+		}
+		packets = append(packets, pkt)
+	}
+	if len(packets) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no event in body")
+	}
+	return packets, 0, nil
+}
+
+var (
+	errExiting   = errors.New("agent is exiting")
+	errQueueFull = errors.New("input queue is full")
+)
+
+//一批事件进入输入队列, 要么全部进入, 要么都不进入
+//http 输入是输入队列唯一的生产者, 持有 enqueueLock 时队列的剩余空间只会增加,
+//剩余空间足够整批事件时逐个发送不会阻塞; 不够时最多等待 EnqueueTimeout
+func (self *HTTPInputService) enqueue(packets []*p.Packet) error {
+	timer := time.NewTimer(self.EnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case self.enqueueLock <- struct{}{}:
+	case <-timer.C:
+		return errQueueFull
+	case <-self.ctx.Agentd.GetExitCh():
+		return errExiting
+	}
+	defer func() { <-self.enqueueLock }()
+
+	inchan := self.ctx.Agentd.Inchan
+	if cap(inchan)-len(inchan) < len(packets) {
+		ticker := time.NewTicker(enqueueCheckInterval)
+		defer ticker.Stop()
+		for cap(inchan)-len(inchan) < len(packets) {
+			select {
+			case <-ticker.C:
+			case <-timer.C:
+				return errQueueFull
+			case <-self.ctx.Agentd.GetExitCh():
+				return errExiting
+			}
+		}
+	}
+	for _, pkt := range packets {
+		inchan <- pkt
+	}
+	return nil
+}
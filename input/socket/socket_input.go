@@ -0,0 +1,390 @@
+package socket
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ModuleName = "socket"
+
+//网络监听输入
+//应用直接通过 TCP 或 UDP 把日志发送给本机的 agent, 至少配置一个:
+//
+//	tcp              TCP 监听地址
+//	udp              UDP 监听地址
+//	framing          TCP 的帧格式: newline(默认) 按换行符分隔, length_prefixed 为 4 字节大端序长度 + 数据;
+//	                 UDP 的每个数据报为一帧, newline 时数据报中的每一行为一个事件
+//	codec            每一帧的解码: line(默认) 原始数据, json 或 json_lines 为 json 对象
+//	max_connections  同时连接的数量上限(默认 1024, 0 为不限制), 超过时新的连接直接关闭, 每分钟最多记录一次警告
+//	read_timeout     连接超过这个时间(秒)没有数据时关闭, 默认 0 为不关闭
+//	tls_cert         TCP 启用 TLS 的证书与私钥(tls_key), 配置 tls_ca 时要求客户端提供由该 CA 签发的证书
+//
+//每个事件带有连接信息字段 remote_addr、local_addr、protocol, 校验了客户端证书时还有 tls_client_cn,
+//解码后已经存在的同名字段不覆盖
+type SocketInputService struct {
+	ctx *a.Context
+
+	TCP            string
+	UDP            string
+	Framing        string
+	Codec          string
+	MaxSize        int //单个事件的最大字节数
+	MaxConnections int
+	ReadTimeout    time.Duration
+	TLSCert        string
+	TLSKey         string
+	TLSCA          string
+
+	connections int32 //当前的连接数
+	closers     []io.Closer
+	lock        sync.Mutex
+
+	rejected     int       //上次警告之后拒绝的连接数, 只在接受连接的协程中使用
+	rejectWarnAt time.Time //上次记录拒绝连接警告的时间
+}
+
+const (
+	FramingNewline        = "newline"
+	FramingLengthPrefixed = "length_prefixed"
+
+	FieldRemoteAddr  = "remote_addr"
+	FieldLocalAddr   = "local_addr"
+	FieldProtocol    = "protocol"
+	FieldTLSClientCN = "tls_client_cn"
+
+	TagTruncated = "truncated"
+
+	defaultMaxConnections = 1024
+	maxDatagramSize       = 64 * 1024
+	rejectWarnInterval    = time.Minute
+)
+
+func New() *SocketInputService {
+	return &SocketInputService{}
+}
+
+func (self *SocketInputService) SetContext(ctx *a.Context) {
+	self.ctx = ctx
+	self.Framing = FramingNewline
+	self.Codec = codec.Line
+	self.MaxSize = codec.DefaultMaxLineSize
+	self.MaxConnections = defaultMaxConnections
+}
+
+func (self *SocketInputService) Reflesh() {
+
+}
+
+//可通过命令行覆盖的配置项
+func (self *SocketInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"tcp":             reflect.String,
+		"udp":             reflect.String,
+		"framing":         reflect.String,
+		"codec":           reflect.String,
+		"max_size":        reflect.Float64,
+		"max_connections": reflect.Float64,
+		"read_timeout":    reflect.Float64,
+		"tls_cert":        reflect.String,
+		"tls_key":         reflect.String,
+		"tls_ca":          reflect.String,
+	}
+}
+
+//读取插件配置
+func (self *SocketInputService) loadConfig() error {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if !ok {
+		return errors.New("socket input config not found")
+	}
+	self.TCP, _ = configMap["tcp"].(string)
+	self.UDP, _ = configMap["udp"].(string)
+	if v, ok := configMap["framing"].(string); ok && v != "" {
+		self.Framing = v
+	}
+	if v, ok := configMap["codec"].(string); ok && v != "" {
+		self.Codec = v
+	}
+	if v, ok := configMap["max_size"].(float64); ok && v > 0 {
+		self.MaxSize = int(v)
+	}
+	if v, ok := configMap["max_connections"].(float64); ok && v >= 0 {
+		self.MaxConnections = int(v)
+	}
+	if v, ok := configMap["read_timeout"].(float64); ok && v >= 0 {
+		self.ReadTimeout = time.Duration(v * float64(time.Second))
+	}
+	self.TLSCert, _ = configMap["tls_cert"].(string)
+	self.TLSKey, _ = configMap["tls_key"].(string)
+	self.TLSCA, _ = configMap["tls_ca"].(string)
+
+	if self.TCP == "" && self.UDP == "" {
+		return errors.New("socket input needs at least one of tcp and udp")
+	}
+	if self.Framing != FramingNewline && self.Framing != FramingLengthPrefixed {
+		return errors.New("socket input framing must be newline or length_prefixed, got " + self.Framing)
+	}
+	switch self.Codec {
+	case codec.Line, codec.JSON, codec.JSONLines:
+	default:
+		return errors.New("socket input codec must be line, json or json_lines, got " + self.Codec)
+	}
+	return nil
+}
+
+func (self *SocketInputService) StartInput() {
+	if err := self.loadConfig(); err != nil {
+		self.ctx.Logger().Errorf("socket input fail: %s", err)
+		os.Exit(2)
+	}
+	if err := self.listen(); err != nil {
+		self.ctx.Logger().Errorf("socket input fail: %s", err)
+		self.close()
+		os.Exit(2)
+	}
+
+	<-self.ctx.Agentd.GetExitCh()
+	self.close()
+	self.ctx.Logger().Infoln("socket input exit")
+}
+
+//启动所有监听
+func (self *SocketInputService) listen() error {
+	if self.UDP != "" {
+		conn, err := net.ListenPacket("udp", self.UDP)
+		if err != nil {
+			return fmt.Errorf("listen udp %s - %s", self.UDP, err)
+		}
+		self.addCloser(conn)
+		self.ctx.Logger().Infof("plugins input socket, listen on udp %s, framing: %s, codec: %s", conn.LocalAddr(), self.Framing, self.Codec)
+		go self.servePacket(conn)
+	}
+
+	if self.TCP != "" {
+		ln, err := net.Listen("tcp", self.TCP)
+		if err != nil {
+			return fmt.Errorf("listen tcp %s - %s", self.TCP, err)
+		}
+		protocol := "tcp"
+		if self.TLSCert != "" || self.TLSKey != "" {
+			config, err := util.NewServerTLSConfig(self.TLSCert, self.TLSKey, self.TLSCA)
+			if err != nil {
+				ln.Close()
+				return err
+			}
+			ln = tls.NewListener(ln, config)
+			protocol = "tls"
+		}
+		self.addCloser(ln)
+		self.ctx.Logger().Infof("plugins input socket, listen on %s %s, framing: %s, codec: %s, max connections: %d",
+			protocol, ln.Addr(), self.Framing, self.Codec, self.MaxConnections)
+		go self.serveStream(ln, protocol)
+	}
+	return nil
+}
+
+func (self *SocketInputService) addCloser(c io.Closer) {
+	self.lock.Lock()
+	self.closers = append(self.closers, c)
+	self.lock.Unlock()
+}
+
+func (self *SocketInputService) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range self.closers {
+		c.Close()
+	}
+	self.closers = nil
+}
+
+//UDP: 每个数据报为一帧
+func (self *SocketInputService) servePacket(conn net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	local := conn.LocalAddr().String()
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if util.IsClosedConnError(err) {
+				return
+			}
+			self.ctx.Logger().Errorf("socket udp read failed - %s", err)
+			continue
+		}
+		meta := map[string]string{FieldRemoteAddr: addr.String(), FieldLocalAddr: local, FieldProtocol: "udp"}
+		if self.Framing == FramingLengthPrefixed {
+			if !self.sendFrame(buf[:n], false, meta) {
+				return
+			}
+			continue
+		}
+		//数据报中的每一行为一个事件
+		reader := codec.NewLineReader(bytes.NewReader(buf[:n]), self.MaxSize)
+		for {
+			line, err := reader.ReadLine()
+			if err != nil && err != codec.ErrLineTooLong {
+				break
+			}
+			if len(line) == 0 {
+				continue
+			}
+			if !self.sendFrame(line, err == codec.ErrLineTooLong, meta) {
+				return
+			}
+		}
+	}
+}
+
+//TCP: 每个连接一个协程
+func (self *SocketInputService) serveStream(ln net.Listener, protocol string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if util.IsClosedConnError(err) {
+				return
+			}
+			self.ctx.Logger().Errorf("socket %s accept failed - %s", protocol, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if n := atomic.AddInt32(&self.connections, 1); self.MaxConnections > 0 && int(n) > self.MaxConnections {
+			atomic.AddInt32(&self.connections, -1)
+			self.reject(conn, protocol)
+			continue
+		}
+		go func() {
+			defer atomic.AddInt32(&self.connections, -1)
+			self.serveConn(conn, protocol)
+		}()
+	}
+}
+
+//连接数超过上限时关闭新的连接
+//连接大量涌入时每个连接都记录警告会刷屏, 单个连接只记录调试日志, 警告按间隔汇总
+func (self *SocketInputService) reject(conn net.Conn, protocol string) {
+	conn.Close()
+	self.rejected++
+	self.ctx.Logger().Debugf("socket %s connection from %s rejected, too many connections (%d)", protocol, conn.RemoteAddr(), self.MaxConnections)
+	if now := time.Now(); now.Sub(self.rejectWarnAt) >= rejectWarnInterval {
+		self.ctx.Logger().Warnf("socket %s rejected %d connections, too many connections (%d)", protocol, self.rejected, self.MaxConnections)
+		self.rejected = 0
+		self.rejectWarnAt = now
+	}
+}
+
+func (self *SocketInputService) serveConn(conn net.Conn, protocol string) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	meta := map[string]string{FieldRemoteAddr: remote, FieldLocalAddr: conn.LocalAddr().String(), FieldProtocol: protocol}
+
+	//agent 退出时关闭连接
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-self.ctx.Agentd.GetExitCh():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	//TLS 握手在第一次读取时进行, 这里提前完成以便取得客户端证书
+	if tc, ok := conn.(*tls.Conn); ok {
+		if self.ReadTimeout > 0 {
+			tc.SetDeadline(time.Now().Add(self.ReadTimeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			self.ctx.Logger().Warnf("socket tls handshake with %s failed - %s", remote, err)
+			return
+		}
+		tc.SetDeadline(time.Time{})
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			meta[FieldTLSClientCN] = certs[0].Subject.CommonName
+		}
+	}
+	self.ctx.Logger().Debugf("socket %s connection from %s", protocol, remote)
+
+	var (
+		lines  *codec.LineReader
+		frames codec.Decoder
+	)
+	if self.Framing == FramingLengthPrefixed {
+		frames, _ = codec.NewDecoder(codec.LengthPrefixed, conn, self.MaxSize)
+	} else {
+		lines = codec.NewLineReader(conn, self.MaxSize)
+	}
+
+	for {
+		if self.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(self.ReadTimeout))
+		}
+		var (
+			frame     []byte
+			truncated bool
+			err       error
+		)
+		if lines != nil {
+			frame, err = lines.ReadLine()
+			if err == codec.ErrLineTooLong {
+				truncated, err = true, nil
+			}
+		} else {
+			var pkt *p.Packet
+			if pkt, err = frames.Decode(); err == nil {
+				frame = pkt.Data
+			}
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				self.ctx.Logger().Infof("socket %s connection from %s idle for %s, closed", protocol, remote, self.ReadTimeout)
+			} else if err == io.EOF || util.IsClosedConnError(err) {
+				self.ctx.Logger().Debugf("socket %s connection from %s closed", protocol, remote)
+			} else {
+				self.ctx.Logger().Warnf("socket %s connection from %s closed - %s", protocol, remote, err)
+			}
+			return
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if !self.sendFrame(frame, truncated, meta) {
+			return
+		}
+	}
+}
+
+//解码一帧并发送, agent 退出时返回 false
+func (self *SocketInputService) sendFrame(frame []byte, truncated bool, meta map[string]string) bool {
+	pkt, err := codec.DecodeLine(self.Codec, append([]byte(nil), frame...))
+	if err != nil {
+		self.ctx.Logger().Errorf("socket decode failed - %s", err)
+		return true
+	}
+	for k, v := range meta {
+		if _, ok := pkt.Fields[k]; !ok {
+			pkt.SetField(k, v)
+		}
+	}
+	if truncated {
+		pkt.AddTag(TagTruncated)
+	}
+	select {
+	case self.ctx.Agentd.Inchan <- pkt:
+		return true
+	case <-self.ctx.Agentd.GetExitCh():
+		return false
+	}
+}
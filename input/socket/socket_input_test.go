@@ -0,0 +1,320 @@
+package socket
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录警告数量的 logger
+type testLogger struct {
+	a.Logger
+	warnings int32
+}
+
+func (self *testLogger) Warnf(format string, args ...interface{}) {
+	atomic.AddInt32(&self.warnings, 1)
+}
+
+func newTestService() (*SocketInputService, *testLogger) {
+	opts := a.NewOptions("")
+	logger := &testLogger{Logger: opts.Logger}
+	opts.Logger = logger
+	opts.MaxReadChannelSize = 100
+	service := New()
+	service.SetContext(&a.Context{Agentd: a.New(opts, nil)})
+	return service, logger
+}
+
+//取出已经发送的全部事件
+func receivedPackets(service *SocketInputService) []*p.Packet {
+	var packets []*p.Packet
+	for len(service.ctx.Agentd.Inchan) > 0 {
+		packets = append(packets, <-service.ctx.Agentd.Inchan)
+	}
+	return packets
+}
+
+//通过 net.Pipe 把数据发给一个连接, 连接处理结束后返回收到的事件
+func serveData(service *SocketInputService, protocol string, data []byte) []*p.Packet {
+	server, client := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	service.serveConn(server, protocol)
+	return receivedPackets(service)
+}
+
+func lengthPrefixed(frames ...string) []byte {
+	var b []byte
+	for _, frame := range frames {
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+		b = append(append(b, header[:]...), frame...)
+	}
+	return b
+}
+
+func TestSocketFraming(t *testing.T) {
+	cases := []struct {
+		name      string
+		framing   string
+		codec     string
+		maxSize   int
+		input     []byte
+		data      []string
+		truncated []bool
+		warnings  int32
+	}{
+		{"newline", FramingNewline, codec.Line, 1024, []byte("a\n\nb\r\nc"), []string{"a", "b", "c"}, []bool{false, false, false}, 0},
+		{"newline too long", FramingNewline, codec.Line, 4, []byte("abcdefgh\nxy\n"), []string{"abcd", "xy"}, []bool{true, false}, 0},
+		{"length prefixed", FramingLengthPrefixed, codec.Line, 1024, lengthPrefixed("hello", "", "multi\nline"), []string{"hello", "multi\nline"}, []bool{false, false}, 0},
+		//长度超过上限或者数据不完整时关闭连接, 之前的事件照常发送
+		{"length prefixed too long", FramingLengthPrefixed, codec.Line, 4, lengthPrefixed("abc", "toolong", "x"), []string{"abc"}, []bool{false}, 1},
+		{"length prefixed truncated", FramingLengthPrefixed, codec.Line, 1024, lengthPrefixed("abc", "defg")[:12], []string{"abc"}, []bool{false}, 1},
+	}
+	for _, c := range cases {
+		service, logger := newTestService()
+		service.Framing, service.Codec, service.MaxSize = c.framing, c.codec, c.maxSize
+
+		packets := serveData(service, "tcp", c.input)
+		var data []string
+		var truncated []bool
+		for _, pkt := range packets {
+			data = append(data, string(pkt.Data))
+			truncated = append(truncated, pkt.HasTag(TagTruncated))
+			if pkt.Fields[FieldProtocol] != "tcp" || pkt.Fields[FieldRemoteAddr] != "pipe" {
+				t.Errorf("%s: unexpected connection fields %v", c.name, pkt.Fields)
+			}
+		}
+		if !reflect.DeepEqual(data, c.data) || !reflect.DeepEqual(truncated, c.truncated) {
+			t.Errorf("%s: got %q %v, expected %q %v", c.name, data, truncated, c.data, c.truncated)
+		}
+		if n := atomic.LoadInt32(&logger.warnings); n != c.warnings {
+			t.Errorf("%s: %d warnings, expected %d", c.name, n, c.warnings)
+		}
+	}
+}
+
+//解码后已经存在的字段不被连接信息覆盖
+func TestSocketJSONFields(t *testing.T) {
+	service, _ := newTestService()
+	service.Codec = codec.JSONLines
+	packets := serveData(service, "tcp", []byte(`{"message":"hi","remote_addr":"10.0.0.1"}`+"\n"))
+	if len(packets) != 1 {
+		t.Fatalf("expected 1 packet, got %d", len(packets))
+	}
+	fields := packets[0].Fields
+	if fields[FieldRemoteAddr] != "10.0.0.1" || fields[FieldProtocol] != "tcp" || fields[FieldLocalAddr] != "pipe" {
+		t.Fatalf("unexpected fields %v", fields)
+	}
+}
+
+//生成测试用的 CA 与由它签发的证书, 证书与私钥写入 dir 下的 <name>.crt 与 <name>.key
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+func newTestCA(t *testing.T, dir string) *testCA {
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.issue(t, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+func (self *testCA) issue(t *testing.T, name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if self.cert != nil {
+		parent, signer = self.cert, self.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(self.dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(self.dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func (self *testCA) keyPair(t *testing.T, name string) tls.Certificate {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(self.dir, name+".crt"), filepath.Join(self.dir, name+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if client, err = net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestSocketTLSClientCN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "socket_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir)
+	ca.issue(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	ca.issue(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "app-01"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	cases := []struct {
+		name     string
+		tlsCA    string
+		client   []tls.Certificate
+		data     []string
+		clientCN interface{}
+		warnings int32
+	}{
+		{"client cert", filepath.Join(dir, "ca.crt"), []tls.Certificate{ca.keyPair(t, "client")}, []string{"hello"}, "app-01", 0},
+		//要求客户端证书时, 没有证书的连接握手失败
+		{"missing client cert", filepath.Join(dir, "ca.crt"), nil, nil, nil, 1},
+		//不校验客户端证书时没有 tls_client_cn
+		{"no client auth", "", nil, []string{"hello"}, nil, 0},
+	}
+	for _, c := range cases {
+		service, logger := newTestService()
+		config, err := util.NewServerTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), c.tlsCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		//net.Pipe 没有缓冲, 握手失败时双方会同时阻塞在写入上, 这里使用本地的 TCP 连接
+		server, client := tcpPair(t)
+		go func() {
+			conn := tls.Client(client, &tls.Config{ServerName: "localhost", RootCAs: roots, Certificates: c.client})
+			if conn.Handshake() == nil {
+				conn.Write([]byte("hello\n"))
+			}
+			conn.Close()
+		}()
+		service.serveConn(tls.Server(server, config), "tls")
+
+		var data []string
+		for _, pkt := range receivedPackets(service) {
+			data = append(data, string(pkt.Data))
+			if pkt.Fields[FieldProtocol] != "tls" || pkt.Fields[FieldTLSClientCN] != c.clientCN {
+				t.Errorf("%s: unexpected fields %v", c.name, pkt.Fields)
+			}
+		}
+		if !reflect.DeepEqual(data, c.data) {
+			t.Errorf("%s: got %q, expected %q", c.name, data, c.data)
+		}
+		if n := atomic.LoadInt32(&logger.warnings); n != c.warnings {
+			t.Errorf("%s: %d warnings, expected %d", c.name, n, c.warnings)
+		}
+	}
+}
+
+//超过连接数上限的连接被关闭, 连续拒绝只记录一次警告
+func TestSocketMaxConnections(t *testing.T) {
+	service, logger := newTestService()
+	service.MaxConnections = 1
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		service.serveStream(ln, "tcp")
+		close(done)
+	}()
+
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("first\n"))
+	select {
+	case pkt := <-service.ctx.Agentd.Inchan:
+		if string(pkt.Data) != "first" {
+			t.Fatalf("unexpected packet %q", pkt.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first connection not served")
+	}
+
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("connection %d: expected to be closed, got %v", i, err)
+		}
+		conn.Close()
+	}
+
+	ln.Close()
+	<-done
+	if n := atomic.LoadInt32(&logger.warnings); n != 1 {
+		t.Errorf("%d warnings, expected 1", n)
+	}
+	if service.rejected != 4 {
+		t.Errorf("%d rejections since the last warning, expected 4", service.rejected)
+	}
+}
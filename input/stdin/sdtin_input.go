@@ -1,15 +1,28 @@
 package stdin
 
 import (
-	"fmt"
 	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
+	p "github.com/domac/mafio/packet"
+	"io"
+	"os"
+	"reflect"
+	"time"
 )
 
 const ModuleName = "stdin"
 
 //标准输入
+//逐条读取标准输入, 例如: cat app.log | mafio -input=stdin -output=rabbitmq
 type StdinInputService struct {
 	ctx *a.Context
+
+	Codec       string //编解码: line, json, json_lines, msgpack, length_prefixed, multiline
+	MaxLineSize int    //最大行长度, 超过的部分会被截断; length_prefixed 为最大帧长度
+	ExitOnEOF   bool   //读到 EOF 后, 等待输出发送完成再退出; 否则继续等待. 默认只在标准输入为管道或文件时开启
+
+	multiline map[string]interface{} //codec 为 multiline 时的合并配置
+	charset   *codec.Charset         //输入的字符集, 读取时转换为 UTF-8
 }
 
 func New() *StdinInputService {
@@ -18,16 +31,161 @@ func New() *StdinInputService {
 
 func (self *StdinInputService) SetContext(ctx *a.Context) {
 	self.ctx = ctx
+	self.Codec = "line"
+	self.MaxLineSize = codec.DefaultMaxLineSize
+	self.ExitOnEOF = stdinIsPipe()
+}
+
+//标准输入是否为管道或普通文件
+//以守护进程运行时标准输入通常是 /dev/null 或终端, 读到 EOF 不代表数据结束
+func stdinIsPipe() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	mode := fi.Mode()
+	return mode&os.ModeNamedPipe != 0 || mode.IsRegular()
 }
 
 func (self *StdinInputService) Reflesh() {
 
 }
 
+//可通过命令行覆盖的配置项
+func (self *StdinInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"codec":         reflect.String,
+		"max_line_size": reflect.Float64,
+		"exit_on_eof":   reflect.Bool,
+		"multiline":     reflect.Map,
+		"charset":       reflect.String,
+	}
+}
+
+//读取插件配置, 标准输入的配置文件是可选的
+func (self *StdinInputService) loadConfig() error {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if !ok {
+		return nil
+	}
+	if v, ok := configMap["codec"].(string); ok && v != "" {
+		self.Codec = v
+	}
+	if v, ok := configMap["max_line_size"].(float64); ok && v > 0 {
+		self.MaxLineSize = int(v)
+	}
+	if v, ok := configMap["exit_on_eof"].(bool); ok {
+		self.ExitOnEOF = v
+	}
+	self.multiline, _ = configMap["multiline"].(map[string]interface{})
+	if name, ok := configMap["charset"].(string); ok && name != "" {
+		replacement, _ := configMap["charset_replacement"].(string)
+		charset, err := codec.NewCharset(name, replacement)
+		if err != nil {
+			return err
+		}
+		self.charset = charset
+	}
+	return nil
+}
+
+//发送事件, agent 退出时返回 false
+func (self *StdinInputService) send(pkt *p.Packet) bool {
+	if pkt == nil {
+		return true
+	}
+	select {
+	case self.ctx.Agentd.Inchan <- pkt:
+		return true
+	case <-self.ctx.Agentd.GetExitCh():
+		return false
+	}
+}
+
 func (self *StdinInputService) StartInput() {
-	for i := 0; i < 1; i++ {
+	if err := self.loadConfig(); err != nil {
+		self.ctx.Logger().Errorf("stdin input fail: %s", err)
+		os.Exit(2)
+	}
+
+	var input io.Reader = os.Stdin
+	if self.charset != nil {
+		input = self.charset.NewReader(input)
+	}
+	decoder, err := codec.NewDecoder(self.Codec, input, self.MaxLineSize)
+	if err != nil {
+		self.ctx.Logger().Errorf("stdin input fail: %s", err)
+		os.Exit(2)
+	}
+	self.ctx.Logger().Infof("plugins input stdin, codec: %s, max line size: %d", self.Codec, self.MaxLineSize)
+
+	//多行合并
+	var (
+		assembler  *codec.MultilineAssembler
+		flushCheck <-chan time.Time
+	)
+	if self.Codec == codec.Multiline {
+		if assembler, err = codec.NewMultilineAssembler(self.multiline); err != nil {
+			self.ctx.Logger().Errorf("stdin input fail: %s", err)
+			os.Exit(2)
+		}
+		ticker := time.NewTicker(assembler.CheckInterval())
+		defer ticker.Stop()
+		flushCheck = ticker.C
+	}
+
+	//读取标准输入会一直阻塞, 放在单独的协程中, 避免影响退出
+	packets := make(chan *p.Packet)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			pkt, err := decoder.Decode()
+			if err == codec.ErrLineTooLong {
+				self.ctx.Logger().Warnf("stdin line longer than %d bytes, truncated", self.MaxLineSize)
+			} else if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case packets <- pkt:
+			case <-self.ctx.Agentd.GetExitCh():
+				return
+			}
+		}
+	}()
+
+	for {
 		select {
-		case self.ctx.Agentd.Inchan <- []byte(fmt.Sprintf("%d", i)):
+		case pkt := <-packets:
+			if assembler == nil {
+				if !self.send(pkt) {
+					goto exit
+				}
+				continue
+			}
+			for _, event := range assembler.Push(pkt.Data) {
+				if !self.send(event) {
+					goto exit
+				}
+			}
+		case <-flushCheck:
+			if !self.send(assembler.FlushExpired()) {
+				goto exit
+			}
+		case err := <-readErr:
+			if err != io.EOF {
+				self.ctx.Logger().Errorf("read stdin failed - %s", err)
+			}
+			if assembler != nil && !self.send(assembler.Flush()) {
+				goto exit
+			}
+			if self.ExitOnEOF {
+				go self.ctx.Agentd.ExitAfterFlush()
+			} else {
+				self.ctx.Logger().Infoln("stdin reached EOF, keep waiting")
+			}
+			<-self.ctx.Agentd.GetExitCh()
+			goto exit
 		case <-self.ctx.Agentd.GetExitCh():
 			goto exit
 		}
@@ -0,0 +1,270 @@
+package syslog
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//syslog 消息解析
+//
+//RFC5424: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+//	<165>1 2026-10-19T12:00:00.003Z web-01 nginx 1234 ID47 [exampleSDID@32473 iut="3" eventSource="App"] GET / 200
+//RFC3164: <PRI>TIMESTAMP HOSTNAME TAG[PID]: MSG
+//	<34>Oct 19 12:00:00 web-01 sshd[1234]: Accepted publickey for root
+//
+//RFC3164 的时间没有年份与时区, 按 agent 的本地时区取最近的一年; 没有主机名的消息使用发送方的地址
+
+const nilValue = "-"
+
+var (
+	errNoPriority  = errors.New("syslog priority not found")
+	errBadPriority = errors.New("invalid syslog priority")
+	errBadHeader   = errors.New("invalid syslog header")
+)
+
+var facilityLabels = []string{
+	"kernel", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severityLabels = []string{
+	"emergency", "alert", "critical", "error", "warning", "notice", "informational", "debug",
+}
+
+//解析后的消息
+type Message struct {
+	Priority       int
+	Facility       int
+	Severity       int
+	Version        int //RFC3164 为 0
+	Timestamp      time.Time
+	Hostname       string
+	AppName        string
+	ProcId         string
+	MsgId          string
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+func (self *Message) FacilityLabel() string {
+	if self.Facility < len(facilityLabels) {
+		return facilityLabels[self.Facility]
+	}
+	return strconv.Itoa(self.Facility)
+}
+
+func (self *Message) SeverityLabel() string {
+	return severityLabels[self.Severity]
+}
+
+//解析一条消息, 按版本号区分 RFC5424 与 RFC3164
+func Parse(b []byte, now time.Time) (*Message, error) {
+	msg := &Message{}
+	rest, err := msg.parsePriority(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 2 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		err = msg.parse5424(rest)
+	} else {
+		err = msg.parse3164(rest, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (self *Message) parsePriority(b []byte) ([]byte, error) {
+	if len(b) < 3 || b[0] != '<' {
+		return nil, errNoPriority
+	}
+	end := bytes.IndexByte(b[:minInt(len(b), 5)], '>')
+	if end < 2 {
+		return nil, errBadPriority
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return nil, errBadPriority
+	}
+	self.Priority = pri
+	self.Facility = pri / 8
+	self.Severity = pri % 8
+	return b[end+1:], nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+//取出下一个以空格结束的字段
+func nextField(b []byte) (field string, rest []byte, ok bool) {
+	i := bytes.IndexByte(b, ' ')
+	if i < 0 {
+		return string(b), nil, len(b) > 0
+	}
+	return string(b[:i]), b[i+1:], i > 0
+}
+
+func (self *Message) parse5424(b []byte) (err error) {
+	var fields [6]string
+	for i := range fields {
+		var ok bool
+		if fields[i], b, ok = nextField(b); !ok {
+			return errBadHeader
+		}
+	}
+	if self.Version, err = strconv.Atoi(fields[0]); err != nil {
+		return errBadHeader
+	}
+	if fields[1] != nilValue {
+		if self.Timestamp, err = time.Parse(time.RFC3339Nano, fields[1]); err != nil {
+			return errors.New("invalid syslog timestamp: " + fields[1])
+		}
+	}
+	self.Hostname = nilToEmpty(fields[2])
+	self.AppName = nilToEmpty(fields[3])
+	self.ProcId = nilToEmpty(fields[4])
+	self.MsgId = nilToEmpty(fields[5])
+
+	if b, err = self.parseStructuredData(b); err != nil {
+		return
+	}
+	if len(b) > 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+	//UTF-8 编码的消息可能以 BOM 开头
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	self.Message = string(b)
+	return nil
+}
+
+func nilToEmpty(s string) string {
+	if s == nilValue {
+		return ""
+	}
+	return s
+}
+
+//[id key="value" ...][id2 ...], 值中的 \" \\ \] 为转义
+func (self *Message) parseStructuredData(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[0] == '-' {
+		return b[1:], nil
+	}
+	self.StructuredData = map[string]map[string]string{}
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		end := bytes.IndexAny(b, " ]")
+		if end <= 0 {
+			return nil, errors.New("invalid syslog structured data id")
+		}
+		params := map[string]string{}
+		self.StructuredData[string(b[:end])] = params
+		b = b[end:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			eq := bytes.IndexByte(b, '=')
+			if eq <= 0 || len(b) < eq+2 || b[eq+1] != '"' {
+				return nil, errors.New("invalid syslog structured data param")
+			}
+			name := string(b[:eq])
+			value, rest, err := parseParamValue(b[eq+2:])
+			if err != nil {
+				return nil, err
+			}
+			params[name] = value
+			b = rest
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, errors.New("unterminated syslog structured data")
+		}
+		b = b[1:]
+	}
+	return b, nil
+}
+
+//读取到未转义的双引号为止
+func parseParamValue(b []byte) (string, []byte, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			if i+1 < len(b) && (b[i+1] == '"' || b[i+1] == '\\' || b[i+1] == ']') {
+				i++
+			}
+			buf.WriteByte(b[i])
+		case '"':
+			return buf.String(), b[i+1:], nil
+		default:
+			buf.WriteByte(b[i])
+		}
+	}
+	return "", nil, errors.New("unterminated syslog structured data value")
+}
+
+//RFC3164 的时间格式, 部分程序(例如 rsyslog)发送 RFC3339 格式的时间
+const stamp3164 = "Jan _2 15:04:05"
+
+func (self *Message) parse3164(b []byte, now time.Time) error {
+	//时间
+	if len(b) >= len(stamp3164) {
+		if t, err := time.ParseInLocation(stamp3164, string(b[:len(stamp3164)]), now.Location()); err == nil {
+			self.Timestamp = completeYear(t, now)
+			b = bytes.TrimLeft(b[len(stamp3164):], " ")
+		} else if field, rest, ok := nextField(b); ok {
+			if t, err := time.Parse(time.RFC3339Nano, field); err == nil {
+				self.Timestamp = t
+				b = rest
+			}
+		}
+	}
+
+	//时间之后是主机名, 以冒号结束或者含有 [ 的字段是 TAG, 没有主机名
+	if !self.Timestamp.IsZero() {
+		if field, rest, ok := nextField(b); ok && len(rest) > 0 && !strings.HasSuffix(field, ":") && !strings.Contains(field, "[") {
+			self.Hostname = field
+			b = rest
+		}
+	}
+
+	//TAG[PID]: MSG
+	self.Message = string(b)
+	end := bytes.IndexAny(b, ":[ ")
+	if end <= 0 || end > 48 {
+		return nil
+	}
+	tag, pid, rest := string(b[:end]), "", b[end:]
+	if rest[0] == '[' {
+		i := bytes.IndexByte(rest, ']')
+		if i < 0 {
+			return nil
+		}
+		pid, rest = string(rest[1:i]), rest[i+1:]
+	}
+	if len(rest) == 0 || rest[0] != ':' {
+		return nil
+	}
+	self.AppName = tag
+	self.ProcId = pid
+	self.Message = string(bytes.TrimLeft(rest[1:], " "))
+	return nil
+}
+
+//按最近的一年补全时间, 跨年时(例如 1 月 1 日收到 12 月 31 日的消息)为上一年
+func completeYear(t, now time.Time) time.Time {
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	if t.Sub(now) > 24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
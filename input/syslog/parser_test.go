@@ -0,0 +1,250 @@
+package syslog
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testZone = time.FixedZone("CST", 8*3600)
+
+func TestParse5424(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, testZone)
+	cases := []struct {
+		input    string
+		expected Message
+	}{
+		{
+			`<165>1 2026-10-19T12:00:00.003Z web-01 nginx 1234 ID47 [exampleSDID@32473 iut="3" eventSource="App"] GET / 200`,
+			Message{
+				Priority: 165, Facility: 20, Severity: 5, Version: 1,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 3000000, time.UTC),
+				Hostname:  "web-01", AppName: "nginx", ProcId: "1234", MsgId: "ID47",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "App"},
+				},
+				Message: "GET / 200",
+			},
+		},
+		//各字段都是 NILVALUE
+		{
+			`<0>1 - - - - - -`,
+			Message{Version: 1},
+		},
+		{
+			`<191>1 - - - - - - msg`,
+			Message{Priority: 191, Facility: 23, Severity: 7, Version: 1, Message: "msg"},
+		},
+		//值中的转义, 多个 SD-ELEMENT, 以 BOM 开头的消息
+		{
+			"<14>1 2026-10-19T12:00:00+08:00 host app - - " +
+				`[id a="x\"y" b="c\\d" c="e\]f" d="g\h"][id2 k="v" e=""] ` + "\xef\xbb\xbfhello",
+			Message{
+				Priority: 14, Facility: 1, Severity: 6, Version: 1,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, testZone),
+				Hostname:  "host", AppName: "app",
+				StructuredData: map[string]map[string]string{
+					"id":  {"a": `x"y`, "b": `c\d`, "c": "e]f", "d": `g\h`},
+					"id2": {"k": "v", "e": ""},
+				},
+				Message: "hello",
+			},
+		},
+		//没有参数的 SD-ELEMENT, 没有消息
+		{
+			`<14>1 - host - - - [id]`,
+			Message{
+				Priority: 14, Facility: 1, Severity: 6, Version: 1, Hostname: "host",
+				StructuredData: map[string]map[string]string{"id": {}},
+			},
+		},
+	}
+	for _, c := range cases {
+		msg, err := Parse([]byte(c.input), now)
+		if err != nil {
+			t.Errorf("%q: %s", c.input, err)
+			continue
+		}
+		if !msg.Timestamp.Equal(c.expected.Timestamp) {
+			t.Errorf("%q: timestamp %s, expected %s", c.input, msg.Timestamp, c.expected.Timestamp)
+		}
+		msg.Timestamp = c.expected.Timestamp
+		if !reflect.DeepEqual(*msg, c.expected) {
+			t.Errorf("%q:\ngot      %+v\nexpected %+v", c.input, *msg, c.expected)
+		}
+	}
+}
+
+func TestParse3164(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, testZone)
+	cases := []struct {
+		input    string
+		now      time.Time
+		expected Message
+	}{
+		{
+			`<34>Oct 19 12:00:00 web-01 sshd[1234]: Accepted publickey for root`,
+			now,
+			Message{
+				Priority: 34, Facility: 4, Severity: 2,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, testZone),
+				Hostname:  "web-01", AppName: "sshd", ProcId: "1234",
+				Message: "Accepted publickey for root",
+			},
+		},
+		//日期只有一位数
+		{
+			`<13>Oct  5 08:01:02 host app: hi`,
+			now,
+			Message{
+				Priority: 13, Facility: 1, Severity: 5,
+				Timestamp: time.Date(2026, 10, 5, 8, 1, 2, 0, testZone),
+				Hostname:  "host", AppName: "app", Message: "hi",
+			},
+		},
+		//跨年时取上一年
+		{
+			`<13>Dec 31 23:59:00 host app: last`,
+			time.Date(2026, 1, 1, 0, 10, 0, 0, testZone),
+			Message{
+				Priority: 13, Facility: 1, Severity: 5,
+				Timestamp: time.Date(2025, 12, 31, 23, 59, 0, 0, testZone),
+				Hostname:  "host", AppName: "app", Message: "last",
+			},
+		},
+		//没有主机名
+		{
+			`<13>Oct 19 12:00:00 cron[99]: job done`,
+			now,
+			Message{
+				Priority: 13, Facility: 1, Severity: 5,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, testZone),
+				AppName:   "cron", ProcId: "99", Message: "job done",
+			},
+		},
+		//RFC3339 格式的时间带有时区
+		{
+			`<13>2026-10-19T12:00:00Z host app: hi`,
+			now,
+			Message{
+				Priority: 13, Facility: 1, Severity: 5,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC),
+				Hostname:  "host", AppName: "app", Message: "hi",
+			},
+		},
+		//没有时间与 TAG, 整条作为消息
+		{
+			`<13>some message`,
+			now,
+			Message{Priority: 13, Facility: 1, Severity: 5, Message: "some message"},
+		},
+		{
+			`<13>Oct 19 12:00:00 host`,
+			now,
+			Message{
+				Priority: 13, Facility: 1, Severity: 5,
+				Timestamp: time.Date(2026, 10, 19, 12, 0, 0, 0, testZone),
+				Message:   "host",
+			},
+		},
+	}
+	for _, c := range cases {
+		msg, err := Parse([]byte(c.input), c.now)
+		if err != nil {
+			t.Errorf("%q: %s", c.input, err)
+			continue
+		}
+		if !msg.Timestamp.Equal(c.expected.Timestamp) {
+			t.Errorf("%q: timestamp %s, expected %s", c.input, msg.Timestamp, c.expected.Timestamp)
+		}
+		msg.Timestamp = c.expected.Timestamp
+		if !reflect.DeepEqual(*msg, c.expected) {
+			t.Errorf("%q:\ngot      %+v\nexpected %+v", c.input, *msg, c.expected)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, testZone)
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{``, errNoPriority.Error()},
+		{`<1`, errNoPriority.Error()},
+		{`hello`, errNoPriority.Error()},
+		{`<>1 - - - - - -`, errBadPriority.Error()},
+		{`<192>1 - - - - - -`, errBadPriority.Error()},
+		{`<-1>1 - - - - - -`, errBadPriority.Error()},
+		{`<1234>1 - - - - - -`, errBadPriority.Error()},
+		{`<a>1 - - - - - -`, errBadPriority.Error()},
+		{`<14>1 - host app`, errBadHeader.Error()},
+		{`<14>1  - - - - -`, errBadHeader.Error()},
+		{`<14>1 2026-10-19 host app - - -`, "invalid syslog timestamp"},
+		{`<14>1 - - - - - [ k="v"]`, "invalid syslog structured data id"},
+		{`<14>1 - - - - - [id k=v]`, "invalid syslog structured data param"},
+		{`<14>1 - - - - - [id k="v]`, "unterminated syslog structured data value"},
+		{`<14>1 - - - - - [id k="v"`, "unterminated syslog structured data"},
+		{`<14>1 - - - - - [id k="v"x]`, "unterminated syslog structured data"},
+	}
+	for _, c := range cases {
+		msg, err := Parse([]byte(c.input), now)
+		if err == nil {
+			t.Errorf("%q: expected an error, got %+v", c.input, *msg)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("%q: got error %q, expected %q", c.input, err, c.err)
+		}
+	}
+}
+
+func TestFrameReader(t *testing.T) {
+	long := strings.Repeat("x", 40000)
+	cases := []struct {
+		name    string
+		input   string
+		maxSize int
+		frames  []string
+		err     error
+	}{
+		{"newline", "a\nb\r\n\nc", 1024, []string{"a", "b", "", "c"}, io.EOF},
+		{"octet counting", "3 abc4 de\n\n", 1024, []string{"abc", "de"}, io.EOF},
+		{"mixed", "3 abc<13>line\n5 hello", 1024, []string{"abc", "<13>line", "hello"}, io.EOF},
+		{"counted frame keeps newlines", "9 a\nb\nc\n\x00\x00\x00", 1024, []string{"a\nb\nc"}, io.EOF},
+		//超过最大长度的部分丢弃
+		{"counted too long", "10 0123456789x\n", 4, []string{"0123", "x"}, io.EOF},
+		{"line too long", "abcdefgh\nxy\n", 4, []string{"abcd", "xy"}, io.EOF},
+		{"line longer than buffer", long + "\nend\n", 20000, []string{long[:20000], "end"}, io.EOF},
+		{"truncated count", "10 abc", 1024, nil, io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		reader := newFrameReader(strings.NewReader(c.input), c.maxSize)
+		var frames []string
+		var err error
+		for {
+			var frame []byte
+			if frame, err = reader.next(); err != nil {
+				break
+			}
+			frames = append(frames, string(frame))
+		}
+		if err != c.err {
+			t.Errorf("%s: got error %v, expected %v", c.name, err, c.err)
+		}
+		if !reflect.DeepEqual(frames, c.frames) {
+			t.Errorf("%s: got frames %q, expected %q", c.name, frames, c.frames)
+		}
+	}
+
+	//长度不合法
+	for _, input := range []string{"12a hello", "99999"} {
+		reader := newFrameReader(bytes.NewReader([]byte(input)), 1024)
+		if frame, err := reader.next(); err == nil || err == io.EOF {
+			t.Errorf("%q: expected an error, got %q %v", input, frame, err)
+		}
+	}
+}
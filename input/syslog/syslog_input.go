@@ -0,0 +1,421 @@
+package syslog
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	a "github.com/domac/mafio/agent"
+	p "github.com/domac/mafio/packet"
+	"github.com/domac/mafio/util"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ModuleName = "syslog"
+
+//syslog 输入
+//同时监听 UDP、TCP 与 unix datagram socket(例如 /dev/log), 至少配置一个:
+//
+//	udp       UDP 监听地址, 每个数据报一条消息
+//	tcp       TCP 监听地址, 支持按换行符分隔与 octet counting(RFC6587, "长度 消息")两种帧格式, 按每条消息的第一个字符区分
+//	unix      unix datagram socket 路径, 启动时删除已经存在的文件
+//	tls_cert  TCP 启用 TLS 的证书与私钥(tls_key), 配置 tls_ca 时校验客户端证书
+//
+//消息按 RFC5424 或 RFC3164 解析为结构化字段, 原始消息作为事件的数据;
+//解析失败的消息带有 syslog_parse_failure 标签, 只有原始消息与来源字段
+type SyslogInputService struct {
+	ctx *a.Context
+
+	UDP            string
+	TCP            string
+	Unix           string
+	TLSCert        string
+	TLSKey         string
+	TLSCA          string
+	MaxMessageSize int           //单条消息的最大字节数, 超过的 TCP 消息截断
+	ReadTimeout    time.Duration //TCP 连接超过这个时间没有数据时关闭, 0 为不关闭
+
+	hostname string //unix socket 的消息没有主机名时使用本机的主机名
+	closers  []io.Closer
+	lock     sync.Mutex
+}
+
+const (
+	TagParseFailure = "syslog_parse_failure"
+
+	defaultMaxMessageSize = 64 * 1024
+)
+
+//事件字段
+const (
+	FieldPriority       = "priority"
+	FieldFacility       = "facility"
+	FieldFacilityLabel  = "facility_label"
+	FieldSeverity       = "severity"
+	FieldSeverityLabel  = "severity_label"
+	FieldVersion        = "version"
+	FieldTimestamp      = "timestamp"
+	FieldHost           = "host"
+	FieldApp            = "app"
+	FieldProcId         = "procid"
+	FieldMsgId          = "msgid"
+	FieldStructuredData = "structured_data"
+	FieldRemoteAddr     = "remote_addr"
+	FieldProtocol       = "protocol"
+)
+
+func New() *SyslogInputService {
+	return &SyslogInputService{}
+}
+
+func (self *SyslogInputService) SetContext(ctx *a.Context) {
+	self.ctx = ctx
+	self.MaxMessageSize = defaultMaxMessageSize
+}
+
+func (self *SyslogInputService) Reflesh() {
+
+}
+
+//可通过命令行覆盖的配置项
+func (self *SyslogInputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"udp":              reflect.String,
+		"tcp":              reflect.String,
+		"unix":             reflect.String,
+		"tls_cert":         reflect.String,
+		"tls_key":          reflect.String,
+		"tls_ca":           reflect.String,
+		"max_message_size": reflect.Float64,
+		"read_timeout":     reflect.Float64,
+	}
+}
+
+//读取插件配置
+func (self *SyslogInputService) loadConfig() error {
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if !ok {
+		return errors.New("syslog input config not found")
+	}
+	self.UDP, _ = configMap["udp"].(string)
+	self.TCP, _ = configMap["tcp"].(string)
+	self.Unix, _ = configMap["unix"].(string)
+	self.TLSCert, _ = configMap["tls_cert"].(string)
+	self.TLSKey, _ = configMap["tls_key"].(string)
+	self.TLSCA, _ = configMap["tls_ca"].(string)
+	if v, ok := configMap["max_message_size"].(float64); ok && v > 0 {
+		self.MaxMessageSize = int(v)
+	}
+	if v, ok := configMap["read_timeout"].(float64); ok && v >= 0 {
+		self.ReadTimeout = time.Duration(v * float64(time.Second))
+	}
+	if self.UDP == "" && self.TCP == "" && self.Unix == "" {
+		return errors.New("syslog input needs at least one of udp, tcp and unix")
+	}
+	return nil
+}
+
+func (self *SyslogInputService) StartInput() {
+	if err := self.loadConfig(); err != nil {
+		self.ctx.Logger().Errorf("syslog input fail: %s", err)
+		os.Exit(2)
+	}
+	self.hostname, _ = os.Hostname()
+	if err := self.listen(); err != nil {
+		self.ctx.Logger().Errorf("syslog input fail: %s", err)
+		self.close()
+		os.Exit(2)
+	}
+
+	<-self.ctx.Agentd.GetExitCh()
+	self.close()
+	if self.Unix != "" {
+		os.Remove(self.Unix)
+	}
+	self.ctx.Logger().Infoln("syslog input exit")
+}
+
+//启动所有监听
+func (self *SyslogInputService) listen() error {
+	if self.UDP != "" {
+		conn, err := net.ListenPacket("udp", self.UDP)
+		if err != nil {
+			return fmt.Errorf("listen udp %s - %s", self.UDP, err)
+		}
+		self.addCloser(conn)
+		self.ctx.Logger().Infof("plugins input syslog, listen on udp %s", conn.LocalAddr())
+		go self.servePacket(conn, "udp")
+	}
+
+	if self.Unix != "" {
+		//上次退出时没有删除的 socket 文件
+		os.Remove(self.Unix)
+		conn, err := net.ListenPacket("unixgram", self.Unix)
+		if err != nil {
+			return fmt.Errorf("listen unix %s - %s", self.Unix, err)
+		}
+		self.addCloser(conn)
+		os.Chmod(self.Unix, 0666)
+		self.ctx.Logger().Infof("plugins input syslog, listen on unix %s", self.Unix)
+		go self.servePacket(conn, "unix")
+	}
+
+	if self.TCP != "" {
+		ln, err := net.Listen("tcp", self.TCP)
+		if err != nil {
+			return fmt.Errorf("listen tcp %s - %s", self.TCP, err)
+		}
+		protocol := "tcp"
+		if self.TLSCert != "" || self.TLSKey != "" {
+			config, err := util.NewServerTLSConfig(self.TLSCert, self.TLSKey, self.TLSCA)
+			if err != nil {
+				ln.Close()
+				return err
+			}
+			ln = tls.NewListener(ln, config)
+			protocol = "tls"
+		}
+		self.addCloser(ln)
+		self.ctx.Logger().Infof("plugins input syslog, listen on %s %s", protocol, ln.Addr())
+		go self.serveStream(ln, protocol)
+	}
+	return nil
+}
+
+func (self *SyslogInputService) addCloser(c io.Closer) {
+	self.lock.Lock()
+	self.closers = append(self.closers, c)
+	self.lock.Unlock()
+}
+
+func (self *SyslogInputService) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, c := range self.closers {
+		c.Close()
+	}
+	self.closers = nil
+}
+
+//数据报: 每个数据报一条消息
+func (self *SyslogInputService) servePacket(conn net.PacketConn, protocol string) {
+	buf := make([]byte, self.MaxMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if util.IsClosedConnError(err) {
+				return
+			}
+			self.ctx.Logger().Errorf("syslog %s read failed - %s", protocol, err)
+			continue
+		}
+		remote := conn.LocalAddr().String()
+		if addr != nil && addr.String() != "" {
+			remote = addr.String()
+		}
+		if !self.send(append([]byte(nil), trimFrame(buf[:n])...), remote, protocol) {
+			return
+		}
+	}
+}
+
+//流: 每个连接一个协程
+func (self *SyslogInputService) serveStream(ln net.Listener, protocol string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if util.IsClosedConnError(err) {
+				return
+			}
+			self.ctx.Logger().Errorf("syslog %s accept failed - %s", protocol, err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go self.serveConn(conn, protocol)
+	}
+}
+
+func (self *SyslogInputService) serveConn(conn net.Conn, protocol string) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().String()
+	self.ctx.Logger().Debugf("syslog %s connection from %s", protocol, remote)
+
+	//agent 退出时关闭连接
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-self.ctx.Agentd.GetExitCh():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	reader := newFrameReader(conn, self.MaxMessageSize)
+	for {
+		if self.ReadTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(self.ReadTimeout))
+		}
+		frame, err := reader.next()
+		if err != nil {
+			if err != io.EOF && !util.IsClosedConnError(err) {
+				self.ctx.Logger().Warnf("syslog %s connection from %s closed - %s", protocol, remote, err)
+			}
+			return
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if !self.send(frame, remote, protocol) {
+			return
+		}
+	}
+}
+
+//解析后发送, agent 退出时返回 false
+func (self *SyslogInputService) send(raw []byte, remote, protocol string) bool {
+	pkt := p.NewPacket(raw)
+	pkt.SetField(FieldRemoteAddr, remote)
+	pkt.SetField(FieldProtocol, protocol)
+
+	msg, err := Parse(raw, time.Now())
+	if err != nil {
+		self.ctx.Logger().Debugf("syslog parse failed from %s - %s", remote, err)
+		pkt.AddTag(TagParseFailure)
+	} else {
+		pkt.SetField(p.FieldMessage, msg.Message)
+		pkt.SetField(FieldPriority, msg.Priority)
+		pkt.SetField(FieldFacility, msg.Facility)
+		pkt.SetField(FieldFacilityLabel, msg.FacilityLabel())
+		pkt.SetField(FieldSeverity, msg.Severity)
+		pkt.SetField(FieldSeverityLabel, msg.SeverityLabel())
+		if msg.Version > 0 {
+			pkt.SetField(FieldVersion, msg.Version)
+		}
+		if !msg.Timestamp.IsZero() {
+			pkt.SetField(FieldTimestamp, msg.Timestamp.Format(time.RFC3339Nano))
+		}
+		host := msg.Hostname
+		if host == "" {
+			host = self.remoteHost(remote, protocol)
+		}
+		setNotEmpty(pkt, FieldHost, host)
+		setNotEmpty(pkt, FieldApp, msg.AppName)
+		setNotEmpty(pkt, FieldProcId, msg.ProcId)
+		setNotEmpty(pkt, FieldMsgId, msg.MsgId)
+		if len(msg.StructuredData) > 0 {
+			pkt.SetField(FieldStructuredData, msg.StructuredData)
+		}
+	}
+
+	select {
+	case self.ctx.Agentd.Inchan <- pkt:
+		return true
+	case <-self.ctx.Agentd.GetExitCh():
+		return false
+	}
+}
+
+func setNotEmpty(pkt *p.Packet, name, v string) {
+	if v != "" {
+		pkt.SetField(name, v)
+	}
+}
+
+//发送方地址中的主机部分, unix socket 为本机
+func (self *SyslogInputService) remoteHost(remote, protocol string) string {
+	if protocol == "unix" {
+		return self.hostname
+	}
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		return host
+	}
+	return ""
+}
+
+//去掉消息末尾的换行符与 \0
+func trimFrame(b []byte) []byte {
+	for len(b) > 0 && (b[len(b)-1] == '\n' || b[len(b)-1] == '\r' || b[len(b)-1] == 0) {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+//TCP 帧
+//以数字开头的消息为 octet counting("长度 消息"), 否则读到换行符为止
+type frameReader struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func newFrameReader(r io.Reader, maxSize int) *frameReader {
+	return &frameReader{reader: bufio.NewReaderSize(r, 16*1024), maxSize: maxSize}
+}
+
+func (self *frameReader) next() ([]byte, error) {
+	c, err := self.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if c[0] >= '1' && c[0] <= '9' {
+		return self.nextCounted()
+	}
+	return self.nextLine()
+}
+
+func (self *frameReader) nextCounted() ([]byte, error) {
+	digits, err := self.reader.ReadSlice(' ')
+	if err != nil {
+		return nil, errors.New("invalid octet counting frame")
+	}
+	n, err := strconv.Atoi(string(digits[:len(digits)-1]))
+	if err != nil || n <= 0 {
+		return nil, errors.New("invalid octet counting frame length: " + string(digits))
+	}
+	keep := n
+	if keep > self.maxSize {
+		keep = self.maxSize
+	}
+	frame := make([]byte, keep)
+	if _, err = io.ReadFull(self.reader, frame); err != nil {
+		return nil, err
+	}
+	//超过最大长度的部分丢弃
+	if n > keep {
+		if _, err = self.reader.Discard(n - keep); err != nil {
+			return nil, err
+		}
+	}
+	return trimFrame(frame), nil
+}
+
+func (self *frameReader) nextLine() ([]byte, error) {
+	var frame []byte
+	for {
+		segment, err := self.reader.ReadSlice('\n')
+		if room := self.maxSize - len(frame); room > 0 {
+			if len(segment) > room {
+				frame = append(frame, segment[:room]...)
+			} else {
+				frame = append(frame, segment...)
+			}
+		}
+		switch err {
+		case nil:
+			return trimFrame(frame), nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(frame) > 0 {
+				return trimFrame(frame), nil
+			}
+		}
+		return nil, err
+	}
+}
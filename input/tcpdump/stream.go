@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	a "github.com/domac/mafio/agent"
+	p "github.com/domac/mafio/packet"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/google/gopacket/tcpassembly/tcpreader"
@@ -22,6 +23,28 @@ type DumpResult struct {
 	PkgType string `json:"pkgtype"`
 }
 
+//生成数据包, 数据保持文本格式, 同时带上结构化字段供路由使用
+func (d *DumpResult) ToPacket() *p.Packet {
+	result := fmt.Sprintf(
+		"SrcIp:%s\nSrcPort:%s\nDstIp:%s\nDstPort:%s\nMethod:%s\nUrl:%s\nPkgType:%s\n",
+		d.SrcIp,
+		d.SrcPort,
+		d.DstIp,
+		d.DstPort,
+		d.Method, d.Url,
+		d.PkgType,
+	)
+	pkt := p.NewPacket([]byte(result))
+	pkt.SetField("SrcIp", d.SrcIp)
+	pkt.SetField("SrcPort", d.SrcPort)
+	pkt.SetField("DstIp", d.DstIp)
+	pkt.SetField("DstPort", d.DstPort)
+	pkt.SetField("Method", d.Method)
+	pkt.SetField("Url", d.Url)
+	pkt.SetField("PkgType", d.PkgType)
+	return pkt
+}
+
 //继承 tcpassembly.StreamFactory
 type httpStreamFactory struct {
 	ctx     *a.Context
@@ -73,21 +96,21 @@ func (h *httpStream) run() {
 				pkgType = pt
 			}
 
-			result := fmt.Sprintf(
-				"SrcIp:%s\nSrcPort:%s\nDstIp:%s\nDstPort:%s\nMethod:%s\nUrl:%s\nPkgType:%s\n",
-				h.net.Src().String(),
-				h.transport.Src().String(),
-				h.net.Dst().String(),
-				h.transport.Dst().String(),
-				req.Method, req.URL.String(),
-				pkgType,
-			)
+			result := &DumpResult{
+				SrcIp:   h.net.Src().String(),
+				SrcPort: h.transport.Src().String(),
+				DstIp:   h.net.Dst().String(),
+				DstPort: h.transport.Dst().String(),
+				Method:  req.Method,
+				Url:     req.URL.String(),
+				PkgType: pkgType,
+			}
 
 			//结果处理
 			req.Body.Close()
 
 			select {
-			case h.ctx.Agentd.Inchan <- []byte(result):
+			case h.ctx.Agentd.Inchan <- result.ToPacket():
 			default: //读channel撑不住的情况,就放弃当前数据
 				println("drop http pack")
 				continue
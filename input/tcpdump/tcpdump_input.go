@@ -4,13 +4,13 @@ import (
 	"errors"
 	"fmt"
 	a "github.com/domac/mafio/agent"
-	"github.com/domac/mafio/util"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	"io"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -57,9 +57,20 @@ func (self *TcpDumpService) Reflesh() {
 
 }
 
+//可通过命令行覆盖的配置项
+func (self *TcpDumpService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"snaplen":          reflect.String,
+		"ttl_per_minutes":  reflect.String,
+		"http_ports":       reflect.Slice,
+		"tcp_ports":        reflect.Slice,
+		"target_processes": reflect.Slice,
+	}
+}
+
 //获取input的配置信息
 func (self *TcpDumpService) GetInputConfigMap() (map[string]interface{}, bool) {
-	configMap, ok := self.ctx.Agentd.GetOptions().PluginsConfigs[ModuleName]
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
 	return configMap, ok
 }
 
@@ -172,24 +183,10 @@ func (self *TcpDumpService) initListenPort() error {
 	self.snaplen = 1600
 	self.ttlPerMinutes = 10
 
+	//命令行参数通过 -set tcpdump.<key>=<value> 覆盖, 例如:
+	//-set tcpdump.snaplen=65535 -set tcpdump.http_ports=80,443,8080
 	configMap, ok := self.GetInputConfigMap()
 
-	//-f='{"logr_path":"/tmp/rr.log","snaplen":"65535","ttl_per_minutes":"15","http_ports":["80","443","8080","10029"],"tcp_ports":[],"target_processes":["kafka","rabbitmq","vms"]}'
-	formatStr := self.ctx.Agentd.GetOptions().FormatStr
-	formatStr = strings.TrimSpace(formatStr)
-
-	//参数化配置
-	if formatStr != "" {
-		self.ctx.Logger().Infof("function string : %s", formatStr)
-		functionMap, err := util.JsonStringToMap(formatStr)
-		if err != nil {
-			self.ctx.Logger().Errorln(err)
-		} else {
-			configMap = functionMap
-		}
-		ok = true
-	}
-
 	if ok {
 		http_ports, isExist := configMap["http_ports"]
 		if isExist {
@@ -300,20 +297,17 @@ func (self *TcpDumpService) processPacket(packet gopacket.Packet) error {
 				pkgType = pt
 			}
 
-			result := fmt.Sprintf(
-				"SrcIp:%s\nSrcPort:%s\nDstIp:%s\nDstPort:%s\nMethod:%s\nUrl:%s\nPkgType:%s\n",
-				srcIp,
-				srcPort,
-				dstIp,
-				dstPort,
-				"", "",
-				pkgType,
-			)
+			result := &DumpResult{
+				SrcIp:   srcIp,
+				SrcPort: srcPort,
+				DstIp:   dstIp,
+				DstPort: dstPort,
+				PkgType: pkgType,
+			}
 
-			//结果处理
 			//结果处理
 			select {
-			case self.ctx.Agentd.Inchan <- []byte(result):
+			case self.ctx.Agentd.Inchan <- result.ToPacket():
 			default: //读channel撑不住的情况,就放弃当前数据
 				println("drop tcp pack")
 			}
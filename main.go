@@ -12,6 +12,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/Sirupsen/logrus"
 	"github.com/domac/mafio/agent"
 	"github.com/domac/mafio/register"
 	"github.com/domac/mafio/version"
@@ -21,6 +22,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"syscall"
 )
 
@@ -40,14 +42,46 @@ var (
 	AgentId      = flagSet.String("m-id", "sky01", "the service name which ectd can find it")
 	AgentGroup   = flagSet.String("m-group", "net01", "the service group which agent work on")
 	Input        = flagSet.String("input", "stdin", "input plugin")
-	Outout       = flagSet.String("output", "stdout", "output plugin")
+	Outout       = flagSet.String("output", "stdout", "output plugin, comma separated for multiple outputs")
 	Filter       = flagSet.String("filter", "valid", "filter plugin")
+	RouteConfig  = flagSet.String("route-config", "", "path to route rules file, decide which outputs receive each event")
 	FilePath     = flagSet.String("filepath", "", "use for file watch")
 	InfluxDBAddr = flagSet.String("influxdb-addr", "", "influxDB addr to metrics")
-
-	formatStr = flagSet.String("f", "", "function string")
+	EtcdEndpoint = flagSet.String("etcd-endpoint", "", "etcd endpoints for service registration, comma separated")
+	EtcdPrefix   = flagSet.String("etcd-prefix", "/mafio/agents", "etcd key prefix, agent registers at <prefix>/<group>/<id>")
+	EtcdTTL      = flagSet.Int("etcd-ttl", 10, "etcd registration lease ttl (seconds)")
+
+	ConfigSource       = flagSet.String("config-source", "", "pull plugin config from: file, http or etcd")
+	ConfigURL          = flagSet.String("config-url", "", "config server url for http config source, fetch <url>/<group>/<id>")
+	ConfigEtcdPrefix   = flagSet.String("config-etcd-prefix", "/mafio/config", "etcd key prefix for etcd config source")
+	ConfigPollInterval = flagSet.Int("config-poll-interval", 30, "config source poll interval (seconds)")
+	ConfigCachePath    = flagSet.String("config-cache-path", "/tmp/mafio_config_cache.json", "last known good config cache file")
+
+	configOverrides = stringArray{}
+
+	//管道测试模式参数
+	testSample   = flagSet.String("sample", "", "sample input file, one event per line (test mode)")
+	testExpected = flagSet.String("expected", "", "expected output file, or directory with <output>.out files (test mode)")
+	testUpdate   = flagSet.Bool("update", false, "write actual results to expected files (test mode)")
+	testCodec    = flagSet.String("test-codec", "", "codec of sample lines: line, json or json_lines, defaults to the input plugin codec (test mode)")
 )
 
+func init() {
+	flagSet.Var(&configOverrides, "set", "override plugin config, <plugin>.<key>=<value>, plugin is the @pluginName of its config (repeatable)")
+}
+
+//可重复的命令行参数
+type stringArray []string
+
+func (a *stringArray) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
+
+func (a *stringArray) String() string {
+	return strings.Join(*a, ",")
+}
+
 //程序封装
 type program struct {
 	Agentd *agent.Agentd
@@ -82,8 +116,19 @@ func (p *program) Start() error {
 		os.Exit(0)
 	}
 
-	fmt.Println(version.Show())
+	fmt.Fprintln(os.Stderr, version.Show())
+
+	opts, pluginsConf := loadOptions()
+
+	//后台进程创建
+	daemon := agent.New(opts, pluginsConf)
+	daemon.Main()
+	p.Agentd = daemon
+	return nil
+}
 
+//解析配置文件与命令行参数, 并初始化插件注册
+func loadOptions() (*agent.Options, interface{}) {
 	var cfg map[string]interface{}
 	if *config != "" {
 		_, err := toml.DecodeFile(*config, &cfg)
@@ -94,16 +139,49 @@ func (p *program) Start() error {
 
 	opts := agent.NewOptions(*config)
 	options.Resolve(opts, flagSet, cfg)
+	opts.ConfigOverrides = configOverrides
 
 	//初始化插件注册
 	register.Init()
 
-	pluginsConf := cfg["plugins_config_paths"]
-	//后台进程创建
+	return opts, cfg["plugins_config_paths"]
+}
+
+//管道测试模式
+//mafio test -config=<config> -sample=<file> -expected=<file|dir> [-update]
+func runPipelineTest(args []string) int {
+	flagSet.Usage = agentUsage
+	flagSet.Parse(args)
+
+	if *testSample == "" || *testExpected == "" {
+		fmt.Fprintln(os.Stderr, "test mode needs -sample and -expected")
+		return 2
+	}
+
+	//测试只关心过滤与路由的结果, 日志只输出告警以上级别
+	agent.SetLogLevel(agent.GetLogger().(*logrus.Logger), "warn")
+
+	opts, pluginsConf := loadOptions()
+	//不连接配置中心与服务注册, 保证测试结果只取决于本地配置
+	opts.ConfigSource = ""
+	opts.EtcdEndpoint = ""
+
 	daemon := agent.New(opts, pluginsConf)
-	daemon.Main()
-	p.Agentd = daemon
-	return nil
+	passed, err := daemon.RunPipelineTest(&agent.PipelineTest{
+		SamplePath:   *testSample,
+		Codec:        *testCodec,
+		ExpectedPath: *testExpected,
+		Update:       *testUpdate,
+		Out:          os.Stdout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: pipeline test failed - %s\n", err)
+		return 2
+	}
+	if !passed {
+		return 1
+	}
+	return 0
 }
 
 //程序停止
@@ -118,6 +196,11 @@ func (p *program) Stop() error {
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	//mafio test ... 只执行管道测试, 不启动后台服务
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runPipelineTest(os.Args[2:]))
+	}
+
 	prg := &program{}
 	if err := svc.Run(prg, syscall.SIGINT, syscall.SIGTERM); err != nil {
 		log.Fatal(err)
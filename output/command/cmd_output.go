@@ -28,7 +28,7 @@ func (self *CommandOutputService) Reflesh() {
 }
 
 //命令调用
-func (self *CommandOutputService) cmdCall(cmd string, wg *sync.WaitGroup) {
+func (self *CommandOutputService) cmdCall(cmd string, wg *sync.WaitGroup) (err error) {
 	defer func() {
 		wg.Done()
 	}()
@@ -40,19 +40,25 @@ func (self *CommandOutputService) cmdCall(cmd string, wg *sync.WaitGroup) {
 	self.agentd.Logger().Infof("[%s] start", cmd)
 
 	cmds := []string{"sh", cmd}
-	_, err := util.ScriptRun(cmds, 0)
+	_, err = util.ScriptRun(cmds, 0)
 
 	if err != nil {
 		self.agentd.Logger().Error(err)
 	}
 	self.agentd.Logger().Infof("[%s] end", cmd)
+	return
 }
 
-func (self *CommandOutputService) DoWrite(packets []*p.Packet) {
+//所有命令都执行之后返回第一个错误
+func (self *CommandOutputService) DoWrite(packets []*p.Packet) error {
+	var firstErr error
 	wg := sync.WaitGroup{}
 	for _, pp := range packets {
 		wg.Add(1)
-		self.cmdCall(string(pp.Data), &wg)
+		if err := self.cmdCall(string(pp.Data), &wg); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 	wg.Wait()
+	return firstErr
 }
@@ -1,17 +1,24 @@
 package logrotator
 
 import (
+	"fmt"
 	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
 	p "github.com/domac/mafio/packet"
-	"github.com/domac/mafio/util"
-	"strings"
+	"os"
+	"reflect"
+	"sync"
 )
 
 const ModuleName = "logr"
 
 type LogROutputService struct {
-	ctx    *a.Context
-	writer *RotatingWriter
+	ctx        *a.Context
+	writer     *RotatingWriter
+	outputPath string
+	encoder    codec.Encoder
+	compressor *codec.Compressor
+	lock       sync.Mutex
 }
 
 func New() *LogROutputService {
@@ -22,46 +29,148 @@ func (self *LogROutputService) SetContext(ctx *a.Context) {
 
 	self.ctx = ctx
 
-	//默认输出路径
-	outputPath := "/tmp/dump.log"
+	encoder, err := self.configEncoder()
+	if err != nil {
+		ctx.Logger().Errorf("logr output fail: %s", err)
+		os.Exit(2)
+	}
+	self.encoder = encoder
+
+	compressor, err := self.configCompressor()
+	if err != nil {
+		ctx.Logger().Errorf("logr output fail: %s", err)
+		os.Exit(2)
+	}
+	self.compressor = compressor
 
-	opts := &Options{
+	outputPath := self.configOutputPath()
+	ctx.Logger().Infof("logr output path: %s, compression: %s", outputPath, compressor.Name())
+
+	writer, _ := NewWriter(outputPath, writerOptions(compressor))
+	self.writer = writer
+	self.outputPath = outputPath
+}
+
+//写入的数据已经压缩时, 轮转后的文件不再用 gzip 压缩
+func writerOptions(compressor *codec.Compressor) *Options {
+	return &Options{
 		RotateDaily: false,
-		Compress:    true,
+		Compress:    compressor.Name() == codec.CompressNone,
 		MaximumSize: 1024 * 1024 * 1024, //1G
 	}
+}
 
-	formatStr := self.ctx.Agentd.GetOptions().FormatStr
-	formatStr = strings.TrimSpace(formatStr)
-
-	//参数化配置
-	if formatStr != "" {
-		functionMap, err := util.JsonStringToMap(formatStr)
-		if err != nil {
-			self.ctx.Logger().Errorln(err)
-		} else {
-			//参数配置路径
-			logr_path_config, snExist := functionMap["logr_path"]
-			if snExist {
-				outputPath = logr_path_config.(string)
-			}
+//获取输出路径
+func (self *LogROutputService) configOutputPath() string {
+	//默认输出路径
+	outputPath := "/tmp/dump.log"
+
+	//参数化配置, 可通过 -set logr.logr_path=<path> 覆盖
+	configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName)
+	if ok {
+		//参数配置路径
+		logr_path_config, snExist := configMap["logr_path"]
+		if snExist {
+			outputPath = logr_path_config.(string)
 		}
 	}
+	return outputPath
+}
 
-	ctx.Logger().Infof("logr output path: %s", outputPath)
+//按配置创建编码器, 默认每个事件一行
+func (self *LogROutputService) configEncoder() (codec.Encoder, error) {
+	name := codec.Line
+	if configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName); ok {
+		if v, ok := configMap["codec"].(string); ok && v != "" {
+			name = v
+		}
+	}
+	return codec.NewEncoder(name)
+}
 
-	writer, _ := NewWriter(outputPath, opts)
-	self.writer = writer
+//按配置创建压缩器, 默认不压缩
+func (self *LogROutputService) configCompressor() (*codec.Compressor, error) {
+	name := codec.CompressNone
+	if configMap, ok := self.ctx.Agentd.GetOptions().PluginConfig(ModuleName); ok {
+		if v, ok := configMap["compression"].(string); ok && v != "" {
+			name = v
+		}
+	}
+	return codec.NewCompressor(name, ModuleName)
+}
+
+//支持通过 Reflesh 重新加载配置
+func (self *LogROutputService) SupportsReload() bool {
+	return true
 }
 
+//配置更新后, 输出路径变化时切换到新文件
 func (self *LogROutputService) Reflesh() {
+	if encoder, err := self.configEncoder(); err != nil {
+		self.ctx.Logger().Errorf("logr reload codec failed - %s", err)
+	} else {
+		self.lock.Lock()
+		self.encoder = encoder
+		self.lock.Unlock()
+	}
+
+	compressor, err := self.configCompressor()
+	if err != nil {
+		self.ctx.Logger().Errorf("logr reload compression failed - %s", err)
+		compressor = self.compressor
+	}
 
+	outputPath := self.configOutputPath()
+	if outputPath == self.outputPath {
+		//同一个文件中不能混合不同的压缩格式, 压缩方式只在切换文件时生效
+		if compressor.Name() != self.compressor.Name() {
+			self.ctx.Logger().Warnf("logr compression change to %s ignored until the output path changes", compressor.Name())
+		}
+		return
+	}
+
+	writer, err := NewWriter(outputPath, writerOptions(compressor))
+	if err != nil {
+		self.ctx.Logger().Errorf("logr reopen %s failed - %s", outputPath, err)
+		return
+	}
+
+	self.lock.Lock()
+	old := self.writer
+	self.writer = writer
+	self.outputPath = outputPath
+	self.compressor = compressor
+	self.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	self.ctx.Logger().Infof("logr output path changed: %s", outputPath)
 }
 
-func (self *LogROutputService) DoWrite(packets []*p.Packet) {
+//可通过命令行覆盖的配置项
+func (self *LogROutputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"logr_path":   reflect.String,
+		"codec":       reflect.String,
+		"compression": reflect.String,
+	}
+}
+
+func (self *LogROutputService) DoWrite(packets []*p.Packet) error {
 
-	for _, pp := range packets {
-		//println(string(pp.Data))
-		self.writer.Write(pp.Data)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	b, err := self.encoder.Encode(packets)
+	if err != nil {
+		return fmt.Errorf("logr encode failed - %s", err)
+	}
+	b, err = self.compressor.Compress(b)
+	if err != nil {
+		return fmt.Errorf("logr compress failed - %s", err)
+	}
+	if _, err = self.writer.Write(b); err != nil {
+		return fmt.Errorf("logr write failed - %s", err)
 	}
+	return nil
 }
@@ -113,6 +113,12 @@ func (w *RotatingWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+func (w *RotatingWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	return w.file.Close()
+}
+
 func (w *RotatingWriter) rotateClear() error {
 	original := w.file.Name()
 	w.currentSize = 0
@@ -2,10 +2,13 @@ package rabbitmq
 
 import (
 	"errors"
+	"fmt"
 	"github.com/bitly/go-hostpool"
 	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
 	p "github.com/domac/mafio/packet"
 	"github.com/streadway/amqp"
+	"reflect"
 	"strings"
 	"time"
 )
@@ -26,6 +29,8 @@ type RabbitmqOutputService struct {
 	hostPool           hostpool.HostPool
 	amqpClients        map[string]amqpClient
 	isCheck            bool
+	encoder            codec.Encoder
+	compressor         *codec.Compressor
 }
 
 type amqpClient struct {
@@ -52,15 +57,31 @@ func (self *RabbitmqOutputService) Reflesh() {
 
 }
 
+//可通过命令行覆盖的配置项
+func (self *RabbitmqOutputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"rmq_address": reflect.String,
+		"rmq_key":     reflect.String,
+		"codec":       reflect.String,
+		"compression": reflect.String,
+	}
+}
+
 func options2map(opt *a.Options) (result map[string]interface{}) {
 
 	result = make(map[string]interface{})
 
-	configMap, ok := opt.PluginsConfigs[ModuleName]
+	configMap, ok := opt.PluginConfig(ModuleName)
 	if !ok {
 		return
 	}
 	result["rmq_key"] = configMap["rmq_key"]
+	if c, ok := configMap["codec"]; ok {
+		result["codec"] = c
+	}
+	if c, ok := configMap["compression"]; ok {
+		result["compression"] = c
+	}
 
 	rmq_address, ok := configMap["rmq_address"]
 	if ok {
@@ -103,6 +124,27 @@ func (self *RabbitmqOutputService) initClient() {
 		retries := opt["retries"].(int64)
 		self.Retries = int(retries)
 	}
+	//默认发送一批事件组成的 json 数组
+	codecName := codec.JSON
+	if c, ok := opt["codec"].(string); ok && c != "" {
+		codecName = c
+	}
+	encoder, err := codec.NewEncoder(codecName)
+	if err != nil {
+		self.ctx.Logger().Errorln(err)
+		encoder, _ = codec.NewEncoder(codec.JSON)
+	}
+	self.encoder = encoder
+
+	//默认不压缩, 压缩时设置消息的 content-encoding
+	compression, _ := opt["compression"].(string)
+	compressor, err := codec.NewCompressor(compression, ModuleName)
+	if err != nil {
+		self.ctx.Logger().Errorln(err)
+		compressor, _ = codec.NewCompressor(codec.CompressNone, ModuleName)
+	}
+	self.compressor = compressor
+
 	self.isCheck = true
 	self.ExchangeDurable = false
 	self.ExchangeAutoDelete = true
@@ -178,29 +220,37 @@ func (self *RabbitmqOutputService) Check() bool {
 	return self.isCheck
 }
 
-func (self *RabbitmqOutputService) DoWrite(packets []*p.Packet) {
+//重试 Retries 次之后仍然失败时返回最后一次的错误
+func (self *RabbitmqOutputService) DoWrite(packets []*p.Packet) error {
 
-	b, err := p.MashallPackets(packets)
+	b, err := self.encoder.Encode(packets)
 
 	if err != nil {
-		return
+		return fmt.Errorf("rabbitmq encode failed - %s", err)
+	}
+
+	b, err = self.compressor.Compress(b)
+	if err != nil {
+		return fmt.Errorf("rabbitmq compress failed - %s", err)
 	}
 
 	for i := 0; i <= self.Retries; i++ {
 		hp := self.hostPool.Get()
-		if err := self.amqpClients[hp.Host()].client.Publish(
+		if err = self.amqpClients[hp.Host()].client.Publish(
 			"",
 			self.Key,
 			false,
 			false,
 			amqp.Publishing{
-				Body: b,
+				ContentEncoding: self.compressor.ContentEncoding(),
+				Body:            b,
 			},
 		); err != nil {
 			hp.Mark(err)
 			self.amqpClients[hp.Host()].reconnect <- hp
 		} else {
-			break
+			return nil
 		}
 	}
+	return fmt.Errorf("rabbitmq publish failed - %s", err)
 }
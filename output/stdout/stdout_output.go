@@ -1,14 +1,21 @@
 package stdout
 
 import (
+	"fmt"
 	a "github.com/domac/mafio/agent"
+	"github.com/domac/mafio/codec"
 	p "github.com/domac/mafio/packet"
+	"os"
+	"reflect"
+	"sync"
 )
 
 const ModuleName = "stdout"
 
 type StdoutOutputService struct {
-	agentd *a.Context
+	agentd  *a.Context
+	encoder codec.Encoder
+	lock    sync.Mutex
 }
 
 func New() *StdoutOutputService {
@@ -17,15 +24,57 @@ func New() *StdoutOutputService {
 
 func (self *StdoutOutputService) SetContext(ctx *a.Context) {
 	self.agentd = ctx
+	encoder, err := self.configEncoder()
+	if err != nil {
+		ctx.Logger().Errorf("stdout output fail: %s", err)
+		os.Exit(2)
+	}
+	self.encoder = encoder
 }
 
-func (self *StdoutOutputService) Reflesh() {
+//按配置创建编码器, 默认每个事件一行
+func (self *StdoutOutputService) configEncoder() (codec.Encoder, error) {
+	name := codec.Line
+	if configMap, ok := self.agentd.Agentd.GetOptions().PluginConfig(ModuleName); ok {
+		if v, ok := configMap["codec"].(string); ok && v != "" {
+			name = v
+		}
+	}
+	return codec.NewEncoder(name)
+}
 
+//支持通过 Reflesh 重新加载配置
+func (self *StdoutOutputService) SupportsReload() bool {
+	return true
 }
 
-func (self *StdoutOutputService) DoWrite(packets []*p.Packet) {
+func (self *StdoutOutputService) Reflesh() {
+	encoder, err := self.configEncoder()
+	if err != nil {
+		self.agentd.Logger().Errorf("stdout output reload failed - %s", err)
+		return
+	}
+	self.lock.Lock()
+	self.encoder = encoder
+	self.lock.Unlock()
+}
 
-	for _, pp := range packets {
-		println(string(pp.Data))
+//可通过命令行覆盖的配置项
+func (self *StdoutOutputService) ConfigKinds() map[string]reflect.Kind {
+	return map[string]reflect.Kind{
+		"codec": reflect.String,
+	}
+}
+
+func (self *StdoutOutputService) DoWrite(packets []*p.Packet) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	b, err := self.encoder.Encode(packets)
+	if err != nil {
+		return fmt.Errorf("stdout encode failed - %s", err)
+	}
+	if _, err = os.Stdout.Write(b); err != nil {
+		return fmt.Errorf("stdout write failed - %s", err)
 	}
+	return nil
 }
@@ -1,17 +1,89 @@
 package packet
 
 import (
+	"fmt"
 	"github.com/pquerna/ffjson/ffjson"
 )
 
+//消息字段名: 原始数据
+const FieldMessage = "message"
+
 type Packet struct {
-	Data []byte
+	Data   []byte
+	Fields map[string]interface{} `json:",omitempty"` //结构化字段
+	Tags   []string               `json:",omitempty"` //标签
 }
 
 func NewPacket(data []byte) *Packet {
 	return &Packet{Data: data}
 }
 
+//获取字段值
+//字段 message 未设置时返回原始数据
+func (self *Packet) GetField(name string) (interface{}, bool) {
+	if v, ok := self.Fields[name]; ok {
+		return v, true
+	}
+	if name == FieldMessage {
+		return string(self.Data), true
+	}
+	return nil, false
+}
+
+//获取字段的字符串形式
+func (self *Packet) GetFieldString(name string) (string, bool) {
+	v, ok := self.GetField(name)
+	if !ok {
+		return "", false
+	}
+	if s, isStr := v.(string); isStr {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
+
+//设置字段值
+func (self *Packet) SetField(name string, v interface{}) {
+	if self.Fields == nil {
+		self.Fields = make(map[string]interface{})
+	}
+	self.Fields[name] = v
+}
+
+//添加标签(去重)
+func (self *Packet) AddTag(tag string) {
+	if !self.HasTag(tag) {
+		self.Tags = append(self.Tags, tag)
+	}
+}
+
+func (self *Packet) HasTag(tag string) bool {
+	for _, t := range self.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+//复制数据包, 用于多路输出时互不影响
+func (self *Packet) Clone() *Packet {
+	c := &Packet{}
+	if self.Data != nil {
+		c.Data = append([]byte(nil), self.Data...)
+	}
+	if self.Fields != nil {
+		c.Fields = make(map[string]interface{}, len(self.Fields))
+		for k, v := range self.Fields {
+			c.Fields[k] = v
+		}
+	}
+	if self.Tags != nil {
+		c.Tags = append([]string(nil), self.Tags...)
+	}
+	return c
+}
+
 //序列化
 func MashallPackets(datas []*Packet) ([]byte, error) {
 	return ffjson.Marshal(datas)
@@ -5,7 +5,11 @@ import (
 	valid "github.com/domac/mafio/filter/default"
 	"github.com/domac/mafio/input/cron"
 	fi "github.com/domac/mafio/input/file"
+	"github.com/domac/mafio/input/generator"
+	"github.com/domac/mafio/input/httpin"
+	"github.com/domac/mafio/input/socket"
 	"github.com/domac/mafio/input/stdin"
+	"github.com/domac/mafio/input/syslog"
 	"github.com/domac/mafio/input/tcpdump"
 	"github.com/domac/mafio/output/command"
 	"github.com/domac/mafio/output/logrotator"
@@ -21,6 +25,10 @@ func Init() {
 	a.RegistInput(stdin.ModuleName, stdin.New())
 	a.RegistInput(tcpdump.ModuleName, tcpdump.New())
 	a.RegistInput(cron.ModuleName, cron.New())
+	a.RegistInput(generator.ModuleName, generator.New())
+	a.RegistInput(syslog.ModuleName, syslog.New())
+	a.RegistInput(socket.ModuleName, socket.New())
+	a.RegistInput(httpin.ModuleName, httpin.New())
 
 	//---------- 注册过滤器插件
 	a.RegistFilter(valid.ModuleName, valid.New())
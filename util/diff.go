@@ -0,0 +1,47 @@
+package util
+
+//逐行比较两组文本, 返回带前缀的差异行
+//" " 表示相同, "-" 表示只在 a 中, "+" 表示只在 b 中
+func DiffLines(a, b []string) []string {
+	//最长公共子序列
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	diff := make([]string, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "-"+a[i])
+			i++
+		default:
+			diff = append(diff, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		diff = append(diff, "-"+a[i])
+	}
+	for ; j < m; j++ {
+		diff = append(diff, "+"+b[j])
+	}
+	return diff
+}
@@ -85,3 +85,11 @@ func IsIntranet(ipStr string) bool {
 
 	return false
 }
+
+//监听或者连接已经关闭时返回的错误
+func IsClosedConnError(err error) bool {
+	if ne, ok := err.(*net.OpError); ok {
+		err = ne.Err
+	}
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}